@@ -0,0 +1,328 @@
+package assembler
+
+import (
+	"io"
+	"strings"
+)
+
+// - Options --------------------------------------------------------------------------------------------------------------------
+
+// Options tune the assembler, the zero value assembles a single file with the strict label rules
+type Options struct {
+	IncludeDirectories []string // searched for included files that are not found next to the file including them
+	Definitions        []string // constants defined as `NAME=value`, without a value the constant is 1
+	RelaxedLabels      bool     // labels can use any letter and be of any length
+	SkipListing        bool     // the listing is not kept, so a big program takes less memory
+}
+
+// labelRules returns the rules the labels are checked against
+func (options Options) labelRules() LabelRules {
+	if options.RelaxedLabels {
+		return RELAXED_LABELS
+	}
+	return STRICT_LABELS
+}
+
+// - Assembler ------------------------------------------------------------------------------------------------------------------
+
+// tokenizeDefinition reads the tokens of a part of a definition from the command line, errors point to the definition
+func tokenizeDefinition(text string, origin Position) (tokens []Token, err error) {
+	source := NewSourceCode()
+	source.Load(strings.NewReader(text), origin.file)
+	tokens, err = NewLexer(source).readLine()
+	return
+}
+
+// parseDefinition turns `NAME=value` into the name and the value of the expression
+func parseDefinition(definition string, rules LabelRules, symbols SymbolTable) (name Token, value Value, err error) {
+	text, expression := definition, "1"
+	if i := strings.Index(definition, "="); i >= 0 {
+		text, expression = definition[:i], definition[i+1:]
+	}
+	origin := NewPosition("-D " + text)
+
+	tokens, err := tokenizeDefinition(text, origin)
+	if err == nil && (len(tokens) != 1 || tokens[0].token != TK_IDENTIFIER || rules.validate(text) != nil) {
+		err = NewSourceError(origin, "\"%s\" is not a valid name", text)
+	}
+	if err != nil {
+		return
+	}
+	name = tokens[0]
+
+	tokens, err = tokenizeDefinition(expression, origin)
+	if err == nil && len(tokens) == 0 {
+		err = NewSourceError(origin, "missing value")
+	}
+	if err != nil {
+		return
+	}
+	p := NewTokenStream(tokens)
+	operand, err := p.parseExpression()
+	if err == nil && !p.AtEnd() {
+		err = NewSourceError(p.Peek(0).start, "unexpected '%s' after value", p.Peek(0).String())
+	}
+	if err == nil {
+		value, err = operand.evaluate(symbols)
+	}
+	return
+}
+
+// defineSymbols adds the definitions from the command line to the symbol table as constants
+func defineSymbols(options Options, symbols SymbolTable, diagnostics *Diagnostics) {
+	for _, definition := range options.Definitions {
+		name, value, err := parseDefinition(definition, options.labelRules(), symbols)
+		if err == nil {
+			err = symbols.assign(name.Value(), value, SY_EQU, name.start)
+			err = atPosition(err, name.start)
+		}
+		if err != nil {
+			diagnostics.add(err)
+		}
+	}
+}
+
+// lineSize determines how many bytes of byte code the line will generate
+func lineSize(line Line) (size int64, ok bool) {
+	if directive, found := findDirective(line.opcode.Value()); found {
+		size, ok = int64(directive.size(line.operands)), true
+		return
+	}
+	if opcode, found := findOpcode(line.opcode.Value()); found {
+		size, ok = int64(opcode.size()), true
+		return
+	}
+	return
+}
+
+// assignSymbol evaluates the expression of a `.equ` or `.set` line and gives the name of the line its value
+func assignSymbol(line Line, symbols SymbolTable) (err error) {
+	if line.label.token == TK_UNKNOWN {
+		err = NewSourceError(line.opcode.start, "%s needs a name", line.opcode.Value())
+		return
+	}
+	if len(line.operands) != 1 {
+		err = NewSourceError(line.opcode.end, "%s needs a single expression", line.opcode.Value())
+		return
+	}
+	value, err := line.operands[0].evaluate(symbols)
+	if err != nil {
+		return
+	}
+	kind := assignments[strings.ToLower(line.opcode.Value())]
+	err = symbols.assign(line.label.Value(), value, kind, line.label.start)
+	err = atPosition(err, line.label.start)
+	return
+}
+
+// checkLabel validates the label of the line as it was written, before a macro made it unique. Using the name of an
+// opcode or directive is allowed, but it is confusing so it gets a warning.
+func checkLabel(label Token, rules LabelRules, diagnostics *Diagnostics) (err error) {
+	name := label.Value()
+	if label.token == TK_UNKNOWN || name == ANONYMOUS_LABEL {
+		return
+	}
+	if i := strings.Index(name, "#"); i >= 0 {
+		name = name[:i]
+	}
+	if err = rules.validate(name); err != nil {
+		err = NewSourceError(label.start, "%s", err.Error())
+		return
+	}
+	if _, found := findOpcode(name); found {
+		diagnostics.add(NewSourceWarning(label.start, "label \"%s\" is also the name of an opcode", name))
+	} else if isKeyword(name) {
+		diagnostics.add(NewSourceWarning(label.start, "label \"%s\" is also the name of a directive", name))
+	}
+	return
+}
+
+// qualify gives the local and anonymous labels of the line their full names, the name of a constant does not start a
+// new scope for local labels
+func qualify(line *Line, scope *Scope) (err error) {
+	if line.label.token != TK_UNKNOWN {
+		var name string
+		if isAssignment(line.opcode.Value()) {
+			name, err = scope.resolve(line.label)
+		} else {
+			name, err = scope.define(line.label)
+		}
+		line.label = line.label.named(name)
+		err = atPosition(err, line.label.start)
+	}
+	for _, operand := range line.operands {
+		if err != nil {
+			return
+		}
+		err = operand.qualify(scope)
+	}
+	return
+}
+
+// emitEarly generates the byte code of the line in the first pass, which works when every symbol it uses is known
+// already. A line that refers to a label further down, or that has any other error or warning, is left to the second
+// pass.
+func emitEarly(line Line, symbols SymbolTable) (code []byte, ok bool) {
+	diagnostics := NewDiagnostics()
+	code, err := emitLine(line, symbols, diagnostics)
+	ok = err == nil && len(diagnostics.errors) == 0
+	return
+}
+
+// firstPass reads the source code, determines the address of every line and fills the symbol table with the labels,
+// so the second pass can also resolve labels that are defined further down in the source code. Every line is handled
+// as soon as it is parsed, so conditional assembly can use the symbols defined above it. The byte code of a line is
+// generated right away if it can be, only the lines that can not are kept for the second pass. The code has room for
+// them at their address.
+func firstPass(lexer *Lexer, options Options, diagnostics *Diagnostics) (listing []ListingLine, pending []Line, symbols SymbolTable, code []byte) {
+	code = []byte{}
+	symbols = NewSymbolTable()
+	defineSymbols(options, symbols, diagnostics)
+	parser := NewParser(lexer, options, symbols, diagnostics)
+	scope := NewScope()
+	address := int64(0)
+	var line Line // declared once, a line that is kept for the second pass is copied into pending
+	for {
+		var ok bool
+		line, ok = parser.nextLine()
+		if !ok {
+			break
+		}
+		if err := checkLabel(line.label, options.labelRules(), diagnostics); err != nil {
+			diagnostics.add(err)
+			continue
+		}
+		if err := qualify(&line, scope); err != nil {
+			diagnostics.add(err)
+			continue
+		}
+		line.address = address
+
+		// a constant only uses the symbols defined above it, a redefinable one gets its value again in the second pass
+		if isAssignment(line.opcode.Value()) {
+			if err := assignSymbol(line, symbols); err != nil {
+				diagnostics.add(err)
+			}
+			if assignments[strings.ToLower(line.opcode.Value())] == SY_SET {
+				line.detach()
+				pending = append(pending, line)
+			}
+			if !options.SkipListing {
+				listing = append(listing, NewListingLine(line, 0))
+			}
+			continue
+		}
+
+		if line.label.token != TK_UNKNOWN {
+			labelErr := symbols.define(line.label.Value(), address, line.label.start)
+			if labelErr != nil {
+				diagnostics.add(NewSourceError(line.label.start, "%s", labelErr.Error()))
+			}
+		}
+
+		size, ok := lineSize(line)
+		if !ok {
+			diagnostics.add(NewSourceError(line.opcode.start, "%s", unknownOpcode(line.opcode.Value()).Error()))
+			continue
+		}
+		if lineCode, ok := emitEarly(line, symbols); ok {
+			code = append(code, lineCode...)
+		} else {
+			code = append(code, make([]byte, size)...)
+			line.detach()
+			pending = append(pending, line)
+		}
+		if !options.SkipListing {
+			listing = append(listing, NewListingLine(line, size))
+		}
+		address += size
+	}
+	for _, err := range scope.check() {
+		diagnostics.add(err)
+	}
+	return
+}
+
+// secondPass generates the byte code for the lines the first pass could not, using the symbol table to resolve the
+// labels
+func secondPass(pending []Line, symbols SymbolTable, code []byte, diagnostics *Diagnostics) {
+	for _, line := range pending {
+		// a redefinable constant gets the value it has at this line again
+		if isAssignment(line.opcode.Value()) {
+			if err := assignSymbol(line, symbols); err != nil {
+				diagnostics.add(err)
+			}
+			continue
+		}
+
+		lineCode, lineErr := emitLine(line, symbols, diagnostics)
+		if lineErr != nil {
+			diagnostics.add(lineErr)
+			continue
+		}
+		copy(code[line.address:], lineCode)
+	}
+}
+
+// assemble turns the source code into byte code, all errors and warnings end up in the diagnostics. The second pass
+// only starts if the first pass went without errors.
+func assemble(lexer *Lexer, options Options, diagnostics *Diagnostics) (listing []ListingLine, symbols SymbolTable, code []byte) {
+	var pending []Line
+	listing, pending, symbols, code = firstPass(lexer, options, diagnostics)
+	if diagnostics.err() != nil {
+		return
+	}
+	secondPass(pending, symbols, code, diagnostics)
+	return
+}
+
+// - Interface ------------------------------------------------------------------------------------------------------------------
+
+// Program is the result of assembling the source code
+type Program struct {
+	Code     []byte  // the byte code for the virtual machine
+	Warnings []error // the warnings, the program was assembled nonetheless
+	listing  []ListingLine
+	symbols  SymbolTable
+}
+
+// WriteListing writes the assembly listing of the program, with Options.SkipListing it only has the symbol table
+func (program *Program) WriteListing(w io.Writer) error {
+	return writeListing(w, program.listing, program.Code, program.symbols)
+}
+
+// assembleSource assembles the source code, all errors and warnings are returned as a single error. Without errors the
+// warnings are part of the program.
+func assembleSource(source *SourceCode, options Options) (program *Program, err error) {
+	diagnostics := NewDiagnostics()
+	program = new(Program)
+	program.listing, program.symbols, program.Code = assemble(NewLexer(source), options, diagnostics)
+	if err = diagnostics.err(); err != nil {
+		program = nil
+		return
+	}
+	program.Warnings = diagnostics.errors
+	return
+}
+
+// Assemble streams the source code from the reader and turns it into byte code, included files are found relative to
+// the current directory
+func Assemble(src io.Reader, options Options) (program *Program, err error) {
+	source := NewSourceCode()
+	if err = source.Load(src, ""); err != nil {
+		return
+	}
+	program, err = assembleSource(source, options)
+	return
+}
+
+// AssembleFile reads the source code from a file and turns it into byte code, included files are found relative to it
+func AssembleFile(fileName string, options Options) (program *Program, err error) {
+	source := NewSourceCode()
+	if err = source.LoadFile(fileName); err != nil {
+		return
+	}
+	defer source.Close()
+	program, err = assembleSource(source, options)
+	return
+}
@@ -0,0 +1,310 @@
+package assembler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// - Test Symbol Table ----------------------------------------------------------------------------------------------------------
+
+func TestSymbolTable(t *testing.T) {
+	symbols := NewSymbolTable()
+	err := symbols.define("start", 5, NewPosition(""))
+	if err != nil {
+		t.Errorf("error: %s", err.Error())
+	}
+	err = symbols.define("start", 6, NewPosition(""))
+	if err == nil {
+		t.Errorf("expected \"duplicate label\" error")
+	}
+
+	value, err := symbols.resolve("start")
+	if err != nil || value.integer != 5 {
+		t.Errorf("wrong value for \"start\", expected 5, got %d (%v)", value.integer, err)
+	}
+	_, err = symbols.resolve("end")
+	if err == nil {
+		t.Errorf("expected \"undefined symbol\" error")
+	}
+}
+
+// - Test Assembler -------------------------------------------------------------------------------------------------------------
+
+func TestFirstPass(t *testing.T) {
+	lexer := newLexer("start: nop\nloop: pushi 1\njmp loop\nend: halt\n")
+
+	diagnostics := NewDiagnostics()
+	listing, pending, symbols, _ := firstPass(lexer, Options{}, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+
+	expected := map[string]int64{"start": 0, "loop": 1, "end": 15}
+	for name, address := range expected {
+		value, err := symbols.resolve(name)
+		if err != nil || value.integer != address {
+			t.Errorf("wrong address for \"%s\", expected %d, got %d (%v)", name, address, value.integer, err)
+		}
+	}
+	if listing[2].address != 10 {
+		t.Errorf("wrong address for line 3, expected 10, got %d", listing[2].address)
+	}
+	// every label is defined above where it is used, so nothing is left for the second pass
+	if len(pending) != 0 {
+		t.Errorf("expected no lines for the second pass, got %d", len(pending))
+	}
+}
+
+func TestForwardReference(t *testing.T) {
+	lexer := newLexer("jmp end\nstart: jz start\nend: halt\n")
+
+	diagnostics := NewDiagnostics()
+	_, _, code := assemble(lexer, Options{}, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	expected := []byte{0x60, 0x0a, 0, 0, 0, 0x61, 0x05, 0, 0, 0, 0x01}
+	if !bytes.Equal(code, expected) {
+		t.Errorf("wrong code, expected % x, got % x", expected, code)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	testCases := []string{
+		"start: nop\nstart: nop\n", // duplicate label
+		"jmp start\n",              // undefined label
+		"start: jump start\n",      // unknown opcode
+		"N .equ 1\nN .equ 2\n",     // constant defined twice
+		"N .equ 1\nN .set 2\n",     // constant redefined
+		"N .set 1\nN: nop\n",       // label with the name of a constant
+		"N .equ end\nend: nop\n",   // constant using a label further down
+		".equ 1\n",                 // constant without a name
+		"N .equ\n",                 // constant without a value
+		"N .equ 1, 2\n",            // constant with two values
+	}
+
+	for i, c := range testCases {
+		lexer := newLexer(c)
+		diagnostics := NewDiagnostics()
+		assemble(lexer, Options{}, diagnostics)
+		if diagnostics.err() == nil {
+			t.Errorf("CaseID %d: expected an error for \"%s\"", i, c)
+		}
+	}
+}
+
+func TestAssembleAllErrors(t *testing.T) {
+	lexer := newLexer("jmp first\nstart: nop\njmp second\nstart: nop\n")
+
+	diagnostics := NewDiagnostics()
+	assemble(lexer, Options{}, diagnostics)
+	if diagnostics.count() != 1 {
+		t.Errorf("wrong number of errors in the first pass, expected 1, got:\n%s", diagnostics.Error())
+	}
+
+	lexer = newLexer("jmp first\nstart: nop\njmp second\n")
+	diagnostics = NewDiagnostics()
+	assemble(lexer, Options{}, diagnostics)
+	if diagnostics.count() != 2 {
+		t.Errorf("wrong number of errors in the second pass, expected 2, got:\n%s", diagnostics.Error())
+	}
+}
+
+func TestDefinitions(t *testing.T) {
+	options := Options{Definitions: []string{"DEBUG", "LEVEL=2 * 3", "NAME=-1"}}
+	lexer := newLexer(".ifdef DEBUG\nsyscall LEVEL\n.endif\n.byte NAME\n")
+	diagnostics := NewDiagnostics()
+	_, symbols, code := assemble(lexer, options, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	expected := []byte{0x70, 0x06, 0xff}
+	if !bytes.Equal(code, expected) {
+		t.Errorf("wrong code, expected % x, got % x", expected, code)
+	}
+	if value, _ := symbols.resolve("DEBUG"); value.integer != 1 {
+		t.Errorf("wrong value for \"DEBUG\", expected 1, got %s", value.String())
+	}
+}
+
+func TestDefinitionErrors(t *testing.T) {
+	testCases := []struct {
+		definition    string
+		expectedError string
+	}{
+		{"1x=2", "-D 1x:1:1: \"1x\" is not a valid name"},
+		{"X=", "-D X:1:1: missing value"},
+		{"X=1 2", "-D X:1:3: unexpected '2' after value"},
+		{"X=Y", "-D X:1:1: undefined symbol \"Y\""},
+		{"X=0b2", "-D X:1:1: invalid token (digit '2' in binary number)"},
+	}
+
+	for i, c := range testCases {
+		lexer := newLexer("nop\n")
+		diagnostics := NewDiagnostics()
+		assemble(lexer, Options{Definitions: []string{c.definition}}, diagnostics)
+		if diagnostics.Error() != c.expectedError {
+			t.Errorf("CaseID %d: expected the error \"%s\", got:\n%s", i, c.expectedError, diagnostics.Error())
+		}
+	}
+}
+
+func TestLocalLabels(t *testing.T) {
+	testCases := []EmitterCase{
+		{"start: nop\n.loop: jnz .loop\nnext: nop\n.loop: jz .loop\n", []byte{0x00, 0x62, 0x01, 0, 0, 0, 0x00, 0x61, 0x07, 0, 0, 0}},
+		{"start: jmp .end\n.end: halt\n", []byte{0x60, 0x05, 0, 0, 0, 0x01}},
+		{".macro wait { .loop: jnz .loop }\nstart: nop\nwait\n.loop: jz .loop\n", []byte{0x00, 0x62, 0x01, 0, 0, 0, 0x61, 0x06, 0, 0, 0}},
+		{"start: nop\n.loop: nop\nnext: jmp start.loop\n", []byte{0x00, 0x00, 0x60, 0x01, 0, 0, 0}},
+		{"start: nop\n.size .equ 4\n.byte .size\n", []byte{0x00, 0x04}},
+		{"@@: jmp @f\n@@: jmp @b\njmp @b\n", []byte{0x60, 0x05, 0, 0, 0, 0x60, 0x05, 0, 0, 0, 0x60, 0x05, 0, 0, 0}},
+		{"@@: jnz @b\n.macro wait { @@: jz @b }\nwait\nwait\njmp @B\n", []byte{
+			0x62, 0x00, 0, 0, 0, 0x61, 0x05, 0, 0, 0, 0x61, 0x0a, 0, 0, 0, 0x60, 0x0a, 0, 0, 0}},
+	}
+
+	for i, c := range testCases {
+		c.verify(t, i)
+	}
+}
+
+func TestLocalLabelErrors(t *testing.T) {
+	testCases := []struct {
+		sourceCode    string
+		expectedError string
+	}{
+		{".loop: nop\n", "1:1: local label \".loop\" has no global label before it"},
+		{"nop\njmp .loop\n", "2:5: local label \".loop\" has no global label before it"},
+		{"main: nop\n.loop: nop\nstart: jmp .loop\n", "3:12: undefined local label \".loop\" under \"start\", it is only defined under \"main\""},
+		{"start: jmp .loop\n", "1:12: undefined local label \".loop\" under \"start\""},
+		{"start: jmp main.loop\n", "1:12: undefined local label \".loop\" under \"main\""},
+		{"start: jmp start.\n", "1:12: invalid token (expected the name of a local label after '.')"},
+		{"start.loop: nop\n", "1:1: label \"start.loop\" can not contain '.'"},
+		{"start: nop\n.loop: nop\n.loop: nop\n", "3:1: duplicate label \"start.loop\", already defined at 2:1"},
+		{"@@: jmp @@\n", "1:9: ambiguous reference to an anonymous label, use @f for the next one or @b for the previous one"},
+		{"jmp @b\n@@: nop\n", "1:5: no anonymous label before @b"},
+		{"@@: nop\njmp @f\n", "2:5: no anonymous label after @f"},
+	}
+
+	for i, c := range testCases {
+		lexer := newLexer(c.sourceCode)
+		diagnostics := NewDiagnostics()
+		assemble(lexer, Options{}, diagnostics)
+		if diagnostics.Error() != c.expectedError {
+			t.Errorf("CaseID %d: expected the error \"%s\", got:\n%s", i, c.expectedError, diagnostics.Error())
+		}
+	}
+}
+
+func TestLabelRules(t *testing.T) {
+	testCases := []struct {
+		name    string
+		strict  bool
+		relaxed bool
+	}{
+		{"start", true, true},
+		{"_loop-1", true, true},
+		{".loop", true, true},
+		{"Start_2", true, true},
+		{"1st", false, false},
+		{"-loop", false, false},
+		{"café", false, true},
+		{"été", false, true},
+		{"x٣", false, true}, // arabic-indic digit
+		{strings.Repeat("a", 64), true, true},
+		{strings.Repeat("a", 65), false, true},
+	}
+
+	for i, c := range testCases {
+		if err := STRICT_LABELS.validate(c.name); (err == nil) != c.strict {
+			t.Errorf("CaseID %d: wrong strict validation of \"%s\", got %v", i, c.name, err)
+		}
+		if err := RELAXED_LABELS.validate(c.name); (err == nil) != c.relaxed {
+			t.Errorf("CaseID %d: wrong relaxed validation of \"%s\", got %v", i, c.name, err)
+		}
+	}
+}
+
+func TestLabelErrors(t *testing.T) {
+	testCases := []struct {
+		sourceCode    string
+		expectedError string
+	}{
+		{"café: nop\n", "1:1: label \"café\" can not contain 'é'"},
+		{strings.Repeat("a", 65) + ": nop\n", "1:1: label \"" + strings.Repeat("a", 65) + "\" is 65 characters long, the maximum is 64"},
+		{"é .equ 1\n", "1:1: label \"é\" must start with a letter or underscore"},
+		{"nop: halt\n", "1:1: warning: label \"nop\" is also the name of an opcode"},
+		{"start: nop\n.byte: halt\n", "2:1: warning: label \".byte\" is also the name of a directive"},
+		{".macro wait { jmp: nop }\nwait\nwait\n", "1:15: warning: label \"jmp\" is also the name of an opcode\n" +
+			"1:15: warning: label \"jmp\" is also the name of an opcode"},
+	}
+
+	for i, c := range testCases {
+		lexer := newLexer(c.sourceCode)
+		diagnostics := NewDiagnostics()
+		assemble(lexer, Options{}, diagnostics)
+		if diagnostics.Error() != c.expectedError {
+			t.Errorf("CaseID %d: expected the error \"%s\", got:\n%s", i, c.expectedError, diagnostics.Error())
+		}
+	}
+
+	lexer := newLexer("café: nop\n")
+	diagnostics := NewDiagnostics()
+	assemble(lexer, Options{RelaxedLabels: true}, diagnostics)
+	if diagnostics.err() != nil {
+		t.Errorf("unexpected error in relaxed mode: %s", diagnostics.Error())
+	}
+}
+
+// - Test Interface -------------------------------------------------------------------------------------------------------------
+
+func TestAssemble(t *testing.T) {
+	testCases := []struct {
+		sourceCode   string
+		expectedCode []byte
+	}{
+		{"start: nop\njmp start\n", []byte{0x00, 0x60, 0x00, 0, 0, 0}},
+		{"start: nop\r\njmp start\r\n", []byte{0x00, 0x60, 0x00, 0, 0, 0}},
+		{"start: nop // first\r\n\r\njmp start\r", []byte{0x00, 0x60, 0x00, 0, 0, 0}},
+		{".macro stop {\r\n  halt\r\n}\r\nstop\r\n", []byte{0x01}},
+		{"nop\n  ", []byte{0x00}},
+		{"halt // done", []byte{0x01}},
+		{".byte \"\x04\"", []byte{0x04}},
+	}
+
+	for i, c := range testCases {
+		program, err := Assemble(strings.NewReader(c.sourceCode), Options{})
+		if err != nil {
+			t.Errorf("CaseID %d: error: %s", i, err.Error())
+			continue
+		}
+		if !bytes.Equal(program.Code, c.expectedCode) {
+			t.Errorf("CaseID %d: wrong code, expected % x, got % x", i, c.expectedCode, program.Code)
+		}
+	}
+}
+
+func TestAssembleDiagnostics(t *testing.T) {
+	program, err := Assemble(strings.NewReader("nop\r\njmp nowhere\r\n"), Options{})
+	if err == nil || err.Error() != "2:5: undefined symbol \"nowhere\"" {
+		t.Errorf("expected the error \"2:5: undefined symbol \\\"nowhere\\\"\", got %v", err)
+	}
+	if program != nil {
+		t.Errorf("expected no program after an error")
+	}
+
+	program, err = Assemble(strings.NewReader("nop: halt\n"), Options{})
+	if err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	if len(program.Warnings) != 1 || program.Warnings[0].Error() != "1:1: warning: label \"nop\" is also the name of an opcode" {
+		t.Errorf("wrong warnings: %v", program.Warnings)
+	}
+
+	var listing bytes.Buffer
+	if err = program.WriteListing(&listing); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	if !strings.HasPrefix(listing.String(), "    1  0000  01                       nop:            halt\n") {
+		t.Errorf("wrong listing:\n%s", listing.String())
+	}
+}
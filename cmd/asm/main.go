@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ralph-nijpels/assembler"
+)
+
+// - Interface ------------------------------------------------------------------------------------------------------------------
+
+// stringList collects the values of an option that can be repeated
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, string(os.PathListSeparator))
+}
+
+func (list *stringList) Set(directory string) error {
+	*list = append(*list, directory)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: asm [options] <filename>, use - as filename to read stdin\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	outputFile := flag.String("o", "", "write the byte code to `file`")
+	listing := flag.Bool("l", false, "show the assembly listing on stdout (default without -o)")
+	directories := stringList{}
+	flag.Var(&directories, "I", "search `directory` for included files, can be repeated")
+	defines := stringList{}
+	flag.Var(&defines, "D", "define the constant `NAME=value` (1 without a value), can be repeated")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Missing source file name\n")
+		usage()
+		os.Exit(2)
+	}
+
+	options := assembler.Options{IncludeDirectories: directories, Definitions: defines, SkipListing: !*listing && *outputFile != ""}
+	var program *assembler.Program
+	var err error
+	if flag.Arg(0) == "-" {
+		program, err = assembler.Assemble(os.Stdin, options)
+	} else {
+		program, err = assembler.AssembleFile(flag.Arg(0), options)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	for _, warning := range program.Warnings {
+		fmt.Fprintln(os.Stderr, warning.Error())
+	}
+
+	if *outputFile != "" {
+		err = os.WriteFile(*outputFile, program.Code, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if *listing || *outputFile == "" {
+		err = program.WriteListing(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+}
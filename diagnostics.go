@@ -0,0 +1,92 @@
+package assembler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// - Source Error ---------------------------------------------------------------------------------------------------------------
+
+// SourceError is an error that can be pinpointed to a position in the source code, a warning is a SourceError that
+// does not stop the assembler.
+type SourceError struct {
+	position Position
+	message  string
+	warning  bool
+}
+
+// Error implements the error interface: `file:line:column: message`
+func (e SourceError) Error() string {
+	if e.warning {
+		return e.position.String() + ": warning: " + e.message
+	}
+	return e.position.String() + ": " + e.message
+}
+
+func NewSourceError(position Position, format string, a ...interface{}) (err error) {
+	err = SourceError{position: position, message: fmt.Sprintf(format, a...)}
+	return
+}
+
+func NewSourceWarning(position Position, format string, a ...interface{}) (err error) {
+	err = SourceError{position: position, message: fmt.Sprintf(format, a...), warning: true}
+	return
+}
+
+// atPosition turns a plain error into a SourceError at the given position, a SourceError keeps its own position
+func atPosition(err error, position Position) error {
+	if _, ok := err.(SourceError); ok || err == nil {
+		return err
+	}
+	return NewSourceError(position, "%s", err.Error())
+}
+
+// isWarning checks if the error is just a warning
+func isWarning(err error) bool {
+	sourceError, ok := err.(SourceError)
+	return ok && sourceError.warning
+}
+
+// - Diagnostics ----------------------------------------------------------------------------------------------------------------
+
+// Diagnostics collects all errors and warnings found in the source code, so they can be reported in one go instead of
+// one at a time
+type Diagnostics struct {
+	errors   []error // errors and warnings in the order they were found
+	failures int     // the number of errors that are not warnings
+}
+
+// add records an error or a warning
+func (d *Diagnostics) add(err error) {
+	d.errors = append(d.errors, err)
+	if !isWarning(err) {
+		d.failures++
+	}
+}
+
+// count returns the number of errors recorded, warnings not included
+func (d *Diagnostics) count() int {
+	return d.failures
+}
+
+// err returns the diagnostics as an error, or nil if nothing went wrong
+func (d *Diagnostics) err() error {
+	if d.count() == 0 {
+		return nil
+	}
+	return d
+}
+
+// Error implements the error interface, showing one error or warning per line
+func (d *Diagnostics) Error() string {
+	messages := make([]string, len(d.errors))
+	for i, err := range d.errors {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+func NewDiagnostics() (d *Diagnostics) {
+	d = new(Diagnostics)
+	return
+}
@@ -0,0 +1,61 @@
+package assembler
+
+import "strings"
+
+// - Directive ------------------------------------------------------------------------------------------------------------------
+
+// Directive describes a data definition, it reserves and initialises memory for constants and variables. Every value
+// is stored little-endian in width bytes.
+type Directive struct {
+	name    string
+	operand int // the kind of values, OT_...
+	width   int // the width of a single value in bytes
+}
+
+// size returns the number of bytes needed for the values, without values a single one is reserved. A string holds a
+// value per byte for .byte and a value per character for the wider integers.
+func (directive Directive) size(operands []*Expression) int {
+	if len(operands) == 0 {
+		return directive.width
+	}
+
+	count := 0
+	for _, operand := range operands {
+		isString := operand.isOperand() && operand.token.token == TK_STRING
+		switch {
+		case isString && directive.operand == OT_INTEGER && directive.width == 1:
+			count += len(operand.token.Value())
+		case isString && directive.operand == OT_INTEGER:
+			count += len(operand.token.characters())
+		default:
+			count++
+		}
+	}
+	return count * directive.width
+}
+
+// directives are all data definitions the assembler knows
+var directives = []Directive{
+	{".byte", OT_INTEGER, 1},
+	{".word", OT_INTEGER, 2},
+	{".int", OT_INTEGER, 8},
+	{".float", OT_FLOAT, 8},
+}
+
+// assignments give a name to the value of an expression instead of reserving memory: `<name> .equ <expression>`
+var assignments = map[string]int{
+	".equ": SY_EQU,
+	".set": SY_SET,
+}
+
+// findDirective looks up the directive by its name
+func findDirective(name string) (directive Directive, ok bool) {
+	for _, directive = range directives {
+		if strings.EqualFold(directive.name, name) {
+			ok = true
+			return
+		}
+	}
+	directive = Directive{}
+	return
+}
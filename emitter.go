@@ -0,0 +1,293 @@
+package assembler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// - Operand values -------------------------------------------------------------------------------------------------------------
+
+// integerValue converts an integer literal into its value
+func integerValue(token Token) (value int64, err error) {
+	switch token.token {
+	case TK_INTEGER:
+		value, err = strconv.ParseInt(token.Value(), 10, 64)
+	case TK_HEXADECIMAL, TK_BINARY, TK_OCTAL:
+		bases := map[int]int{TK_HEXADECIMAL: 16, TK_BINARY: 2, TK_OCTAL: 8}
+		number := token.Value()
+		digits := strings.TrimPrefix(number, "-")
+		var unsigned uint64
+		unsigned, err = strconv.ParseUint(digits, bases[token.token], 64)
+		value = int64(unsigned)
+		// a negative number has to fit as signed
+		if digits != number {
+			if unsigned > 1<<63 {
+				err = strconv.ErrRange
+			}
+			value = -value
+		}
+	case TK_CHAR:
+		value = charValue(token.Value())
+	default:
+		err = fmt.Errorf("expected an integer, got '%s'", token.String())
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("integer '%s' out of range", token.String())
+	}
+	return
+}
+
+// charValue returns the value of a character, a single byte stays a byte so '\xff' is 255
+func charValue(value string) int64 {
+	if len(value) == 1 {
+		return int64(value[0])
+	}
+	c, _ := utf8.DecodeRuneInString(value)
+	return int64(c)
+}
+
+// floatValue converts a float literal into its value, integers are accepted as well
+func floatValue(token Token) (value float64, err error) {
+	switch token.token {
+	case TK_FLOAT, TK_INTEGER:
+		value, err = strconv.ParseFloat(token.Value(), 64)
+		// an underflow is not an error, floatPrecision warns about it
+		if err != nil && value == 0 {
+			err = nil
+		}
+		if err != nil {
+			err = fmt.Errorf("float '%s' out of range", token.String())
+		}
+	case TK_HEXADECIMAL, TK_BINARY, TK_OCTAL, TK_CHAR:
+		var integer int64
+		integer, err = integerValue(token)
+		value = float64(integer)
+	default:
+		err = fmt.Errorf("expected a float, got '%s'", token.String())
+	}
+	return
+}
+
+// - Encoding -------------------------------------------------------------------------------------------------------------------
+
+// encodeInteger stores the value little-endian in width bytes, it has to fit either as signed or as unsigned
+func encodeInteger(value int64, width int) (code []byte, err error) {
+	if width < 8 {
+		bits := uint(8 * width)
+		if value < -(1<<(bits-1)) || value > (1<<bits)-1 {
+			err = fmt.Errorf("value %d does not fit in %d byte(s)", value, width)
+			return
+		}
+	}
+
+	buffer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buffer, uint64(value))
+	code = buffer[:width]
+	return
+}
+
+// encodeString stores the string as a sequence of values: for single bytes that is UTF-8, wider values hold one
+// character or \x escape each
+func encodeString(token Token, width int) (code []byte, err error) {
+	if width == 1 {
+		code = []byte(token.Value())
+		return
+	}
+
+	code = []byte{}
+	for _, c := range token.characters() {
+		var encoded []byte
+		encoded, err = encodeInteger(c, width)
+		if err != nil {
+			return
+		}
+		code = append(code, encoded...)
+	}
+	return
+}
+
+// encodeFloat stores the value little-endian in IEEE 754 format, width is either 4 or 8 bytes
+func encodeFloat(value float64, width int) (code []byte, err error) {
+	switch width {
+	case 4:
+		if !math.IsInf(value, 0) && math.IsInf(float64(float32(value)), 0) {
+			err = fmt.Errorf("float %g does not fit in 4 bytes", value)
+			return
+		}
+		code = make([]byte, 4)
+		binary.LittleEndian.PutUint32(code, math.Float32bits(float32(value)))
+	case 8:
+		code = make([]byte, 8)
+		binary.LittleEndian.PutUint64(code, math.Float64bits(value))
+	default:
+		err = fmt.Errorf("floats can not be %d byte(s) wide", width)
+	}
+	return
+}
+
+// significantDigits counts the digits of a decimal float literal that matter, leading and trailing zeroes do not count
+func significantDigits(literal string) (count int, nonZero bool) {
+	mantissa := strings.TrimLeft(literal, "+-")
+	if i := strings.IndexAny(mantissa, "eE"); i >= 0 {
+		mantissa = mantissa[:i]
+	}
+	mantissa = strings.Replace(mantissa, ".", "", 1)
+	mantissa = strings.Trim(mantissa, "0")
+	for _, c := range mantissa {
+		if !unicode.IsDigit(c) {
+			return 0, true // inf or nan
+		}
+	}
+	return len(mantissa), len(mantissa) > 0
+}
+
+// floatPrecision checks how well the float literal survives the conversion to a float of width bytes. It returns a
+// warning if the value underflows to zero, ends up denormalised or is written with more digits than the float holds.
+func floatPrecision(literal string, value float64, width int) (warning string) {
+	maxDigits, smallestNormal := 17, 2.2250738585072014e-308
+	if width == 4 {
+		maxDigits, smallestNormal = 9, 1.1754943508222875e-38
+		value = float64(float32(value))
+	}
+
+	digits, nonZero := significantDigits(literal)
+	switch {
+	case nonZero && value == 0:
+		warning = fmt.Sprintf("float %s underflows to zero in %d bytes", literal, width)
+	case value != 0 && math.Abs(value) < smallestNormal:
+		warning = fmt.Sprintf("float %s loses precision, it is denormalised in %d bytes", literal, width)
+	case digits > maxDigits:
+		warning = fmt.Sprintf("float %s has more digits than %d bytes can hold", literal, width)
+	}
+	return
+}
+
+// - Emitter --------------------------------------------------------------------------------------------------------------------
+
+// emitOperand generates the byte code for a single operand of the given kind and width
+func emitOperand(kind int, width int, operand *Expression, symbols SymbolTable, diagnostics *Diagnostics) (code []byte, err error) {
+	defer func() {
+		err = atPosition(err, operand.start())
+	}()
+
+	// a string as immediate packs its bytes into the operand
+	token := operand.token
+	if operand.isOperand() && token.token == TK_STRING {
+		if kind != OT_INTEGER {
+			err = fmt.Errorf("a string can not be used here")
+			return
+		}
+		text := token.Value()
+		if len(text) > width {
+			err = fmt.Errorf("string %s does not fit in %d byte(s)", token.String(), width)
+			return
+		}
+		code = make([]byte, width)
+		copy(code, text)
+		return
+	}
+
+	value, err := operand.evaluate(symbols)
+	if err != nil {
+		return
+	}
+	switch kind {
+	case OT_INTEGER:
+		if value.isFloat {
+			err = fmt.Errorf("expected an integer, got '%s'", operand.String())
+			return
+		}
+		code, err = encodeInteger(value.integer, width)
+	case OT_FLOAT:
+		code, err = encodeFloat(value.asFloat(), width)
+		if err == nil && value.isFloat {
+			literal := value.String()
+			if operand.isOperand() {
+				literal = token.Value()
+			}
+			if warning := floatPrecision(literal, value.float, width); warning != "" {
+				diagnostics.add(NewSourceWarning(operand.start(), "%s", warning))
+			}
+		}
+	case OT_ADDRESS:
+		if value.isFloat {
+			err = fmt.Errorf("expected an address, got '%s'", operand.String())
+			return
+		}
+		if value.integer < 0 {
+			err = fmt.Errorf("address %d is negative", value.integer)
+			return
+		}
+		code, err = encodeInteger(value.integer, width)
+	}
+	return
+}
+
+// emitInstruction generates the byte code for an instruction: the opcode followed by its operand
+func emitInstruction(line Line, opcode Opcode, symbols SymbolTable, diagnostics *Diagnostics) (code []byte, err error) {
+	if opcode.operand == OT_NONE && len(line.operands) > 0 {
+		err = NewSourceError(line.operands[0].start(), "%s does not take an operand", opcode.mnemonic)
+		return
+	}
+	if opcode.operand != OT_NONE && len(line.operands) == 0 {
+		err = NewSourceError(line.opcode.end, "%s needs an operand", opcode.mnemonic)
+		return
+	}
+	if len(line.operands) > 1 {
+		err = NewSourceError(line.operands[1].start(), "%s takes only one operand", opcode.mnemonic)
+		return
+	}
+
+	code = []byte{opcode.code}
+	if opcode.operand != OT_NONE {
+		var operand []byte
+		operand, err = emitOperand(opcode.operand, opcode.width, line.operands[0], symbols, diagnostics)
+		code = append(code, operand...)
+	}
+	return
+}
+
+// emitData generates the byte code for a data definition: all values one after the other, or zeroes if there are none
+func emitData(line Line, directive Directive, symbols SymbolTable, diagnostics *Diagnostics) (code []byte, err error) {
+	if len(line.operands) == 0 {
+		code = make([]byte, directive.width)
+		return
+	}
+
+	code = []byte{}
+	for _, operand := range line.operands {
+		var value []byte
+		if operand.isOperand() && operand.token.token == TK_STRING && directive.operand == OT_INTEGER {
+			value, err = encodeString(operand.token, directive.width)
+			err = atPosition(err, operand.start())
+		} else {
+			value, err = emitOperand(directive.operand, directive.width, operand, symbols, diagnostics)
+		}
+		if err != nil {
+			return
+		}
+		code = append(code, value...)
+	}
+	return
+}
+
+// emitLine generates the byte code for a single line, errors are reported at the offending part of the line. Warnings
+// do not stop the byte code from being generated, so they are added to the diagnostics straight away.
+func emitLine(line Line, symbols SymbolTable, diagnostics *Diagnostics) (code []byte, err error) {
+	if directive, ok := findDirective(line.opcode.Value()); ok {
+		code, err = emitData(line, directive, symbols, diagnostics)
+		return
+	}
+	if opcode, ok := findOpcode(line.opcode.Value()); ok {
+		code, err = emitInstruction(line, opcode, symbols, diagnostics)
+		return
+	}
+	err = NewSourceError(line.opcode.start, "%s", unknownOpcode(line.opcode.Value()).Error())
+	return
+}
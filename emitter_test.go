@@ -0,0 +1,276 @@
+package assembler
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// - Support functions to prevent repetition ------------------------------------------------------------------------------------
+
+type EmitterCase struct {
+	sourceCode   string
+	expectedCode []byte
+}
+
+func (c EmitterCase) verify(t *testing.T, caseId int) {
+	lexer := newLexer(c.sourceCode)
+
+	diagnostics := NewDiagnostics()
+	_, _, code := assemble(lexer, Options{}, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Errorf("CaseID %d: %s", caseId, err.Error())
+		return
+	}
+	if !bytes.Equal(code, c.expectedCode) {
+		t.Errorf("CaseID %d: wrong code, expected % x, got % x", caseId, c.expectedCode, code)
+	}
+}
+
+// - Test Opcodes ---------------------------------------------------------------------------------------------------------------
+
+func TestFindOpcode(t *testing.T) {
+	opcode, ok := findOpcode("jmp")
+	if !ok {
+		t.Fatalf("expected to find \"jmp\"")
+	}
+	if opcode.code != 0x60 || opcode.operand != OT_ADDRESS || opcode.size() != 5 {
+		t.Errorf("wrong opcode for \"jmp\": %v", opcode)
+	}
+
+	_, ok = findOpcode("jump")
+	if ok {
+		t.Errorf("did not expect to find \"jump\"")
+	}
+}
+
+func TestUniqueOpcodes(t *testing.T) {
+	mnemonics := map[string]bool{}
+	codes := map[byte]bool{}
+	for _, opcode := range opcodes {
+		if mnemonics[opcode.mnemonic] {
+			t.Errorf("duplicate mnemonic \"%s\"", opcode.mnemonic)
+		}
+		if codes[opcode.code] {
+			t.Errorf("duplicate code 0x%02x", opcode.code)
+		}
+		mnemonics[opcode.mnemonic] = true
+		codes[opcode.code] = true
+	}
+}
+
+// - Test Encoding --------------------------------------------------------------------------------------------------------------
+
+func TestEncodeInteger(t *testing.T) {
+	code, err := encodeInteger(-1, 2)
+	if err != nil || !bytes.Equal(code, []byte{0xff, 0xff}) {
+		t.Errorf("wrong encoding of -1: % x (%v)", code, err)
+	}
+	code, err = encodeInteger(0x1234, 4)
+	if err != nil || !bytes.Equal(code, []byte{0x34, 0x12, 0x00, 0x00}) {
+		t.Errorf("wrong encoding of 0x1234: % x (%v)", code, err)
+	}
+	_, err = encodeInteger(256, 1)
+	if err == nil {
+		t.Errorf("expected 256 not to fit in 1 byte")
+	}
+	_, err = encodeInteger(-129, 1)
+	if err == nil {
+		t.Errorf("expected -129 not to fit in 1 byte")
+	}
+}
+
+func TestEncodeFloat(t *testing.T) {
+	code, err := encodeFloat(1.0, 8)
+	if err != nil || !bytes.Equal(code, []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}) {
+		t.Errorf("wrong encoding of 1.0: % x (%v)", code, err)
+	}
+	code, err = encodeFloat(1.0, 4)
+	if err != nil || !bytes.Equal(code, []byte{0, 0, 0x80, 0x3f}) {
+		t.Errorf("wrong encoding of 1.0: % x (%v)", code, err)
+	}
+	_, err = encodeFloat(1.0, 2)
+	if err == nil {
+		t.Errorf("expected an error for 2 byte floats")
+	}
+}
+
+func TestEncodeFloatOverflow(t *testing.T) {
+	_, err := encodeFloat(1e39, 4)
+	if err == nil {
+		t.Errorf("expected 1e39 not to fit in 4 bytes")
+	}
+	_, err = encodeFloat(math.Inf(-1), 4)
+	if err != nil {
+		t.Errorf("error: %s", err.Error())
+	}
+	_, err = encodeFloat(1e300, 8)
+	if err != nil {
+		t.Errorf("error: %s", err.Error())
+	}
+}
+
+func TestFloatPrecision(t *testing.T) {
+	testCases := []struct {
+		literal string
+		width   int
+		warning bool
+	}{
+		{"1.5", 8, false},
+		{"1.5", 4, false},
+		{"0.0", 8, false},
+		{"inf", 4, false},
+		{"nan", 8, false},
+		{"1e-400", 8, true},                 // underflow
+		{"1e-50", 4, true},                  // underflow
+		{"1e-310", 8, true},                 // denormalised
+		{"1e-40", 4, true},                  // denormalised
+		{"3.14159265358979323846", 8, true}, // too many digits
+		{"3.1415927", 4, false},
+		{"3.141592653", 4, true}, // too many digits
+		{"100000000000000000000.0", 8, false},
+	}
+
+	for i, c := range testCases {
+		value, _ := strconv.ParseFloat(c.literal, 64)
+		warning := floatPrecision(c.literal, value, c.width)
+		if (warning != "") != c.warning {
+			t.Errorf("CaseID %d: wrong warning for %s in %d bytes: \"%s\"", i, c.literal, c.width, warning)
+		}
+	}
+}
+
+func TestEmitWarnings(t *testing.T) {
+	lexer := newLexer(".float 1e-400, 1.5\npushf 1e-310\n")
+
+	diagnostics := NewDiagnostics()
+	_, _, code := assemble(lexer, Options{}, diagnostics)
+	if diagnostics.count() != 0 {
+		t.Errorf("unexpected errors:\n%s", diagnostics.Error())
+	}
+	if len(diagnostics.errors) != 2 {
+		t.Errorf("wrong number of warnings, expected 2, got:\n%s", diagnostics.Error())
+	}
+	if len(code) != 25 {
+		t.Errorf("wrong code size, expected 25, got %d", len(code))
+	}
+}
+
+func TestUnknownOpcode(t *testing.T) {
+	testCases := []struct {
+		name          string
+		expectedError string
+	}{
+		{"jmpp", "unknown opcode \"jmpp\", did you mean \"jmp\"?"},
+		{"HLT", "unknown opcode \"HLT\", did you mean \"halt\"?"},
+		{".bytes", "unknown directive \".bytes\", did you mean \".byte\"?"},
+		{"jump", "unknown opcode \"jump\", did you mean \"jmp\"?"},
+		{"jpm", "unknown opcode \"jpm\", did you mean \"jmp\"?"},
+		{".ybte", "unknown directive \".ybte\", did you mean \".byte\"?"},
+		{"frobnicate", "unknown opcode \"frobnicate\""},
+	}
+
+	for i, c := range testCases {
+		if err := unknownOpcode(c.name); err.Error() != c.expectedError {
+			t.Errorf("CaseID %d: expected the error \"%s\", got \"%s\"", i, c.expectedError, err.Error())
+		}
+	}
+}
+
+// - Test Emitter ---------------------------------------------------------------------------------------------------------------
+
+func TestEmit(t *testing.T) {
+	testCases := []EmitterCase{
+		{"nop\n", []byte{0x00}},
+		{"nop\nhalt\n", []byte{0x00, 0x01}},
+		{"pushi -2\n", []byte{0x10, 0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"pushf 1.0\n", []byte{0x11, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		{"jmp 0x10\n", []byte{0x60, 0x10, 0x00, 0x00, 0x00}},
+		{"syscall 3\n", []byte{0x70, 0x03}},
+		{".byte 1, 0xff, -1\n", []byte{0x01, 0xff, 0xff}},
+		{".word 0x1234\n", []byte{0x34, 0x12}},
+		{".int -2\n", []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{".float 1.0, 2\n", []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0, 0, 0, 0, 0, 0, 0, 0x40}},
+		{".word\n", []byte{0x00, 0x00}},
+		{"value: .byte 7\nload value\n", []byte{0x07, 0x20, 0x00, 0x00, 0x00, 0x00}},
+		{"jmp start\ncounter: .word 1\nstart: load counter\n", []byte{0x60, 0x07, 0, 0, 0, 0x01, 0x00, 0x20, 0x05, 0, 0, 0}},
+		{".byte \"hi\\n\", 0\n", []byte{'h', 'i', '\n', 0x00}},
+		{".byte \"\u00e9\"\n", []byte{0xc3, 0xa9}},
+		{".word \"\u00e9A\"\n", []byte{0xe9, 0x00, 0x41, 0x00}},
+		{".word \"\\xff\\u00ff\", '\\xff'\n", []byte{0xff, 0x00, 0xff, 0x00, 0xff, 0x00}},
+		{"msg: .int \"\\x80\"\nend: .byte end\n", []byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0x08}},
+		{"msg: .word \"\\xc3\\xa9\"\nend: .byte end\n", []byte{0xc3, 0x00, 0xa9, 0x00, 0x04}},
+		{".word \"\\xe2\\x82\\xac\"\n", []byte{0xe2, 0x00, 0x82, 0x00, 0xac, 0x00}},
+		{".byte 'A', '\\xff'\n", []byte{0x41, 0xff}},
+		{"syscall 'A'\n", []byte{0x70, 0x41}},
+		{"pushi \"AB\"\n", []byte{0x10, 0x41, 0x42, 0, 0, 0, 0, 0, 0}},
+		{"msg: .byte \"abc\"\nend: .word end\n", []byte{'a', 'b', 'c', 0x03, 0x00}},
+		{".byte 0b1010_0001, 0o17, 0x1_f\n", []byte{0xa1, 0x0f, 0x1f}},
+		{".word 1_000\n", []byte{0xe8, 0x03}},
+		{".float 1e0, inf\n", []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0, 0, 0, 0, 0, 0, 0xf0, 0x7f}},
+		{"pushf 2.5e-1\n", []byte{0x11, 0, 0, 0, 0, 0, 0, 0xd0, 0x3f}},
+		{"syscall 2 + 3 * 4\n", []byte{0x70, 0x0e}},
+		{"syscall (2 + 3) * 4\n", []byte{0x70, 0x14}},
+		{"syscall 5 -3\n", []byte{0x70, 0x02}},
+		{".byte -(1 << 2), ~0, 0xf0 >> 4 | 1, 7 % 4 ^ 1, 6 & 3\n", []byte{0xfc, 0xff, 0x0f, 0x02, 0x02}},
+		{"table: .byte 1, 2\n.byte table + 1\n", []byte{0x01, 0x02, 0x01}},
+		{"start: nop\nend: .byte end - start\n", []byte{0x00, 0x01}},
+		{"jmp end + 1\nend: halt\n", []byte{0x60, 0x06, 0, 0, 0, 0x01}},
+		{".float -inf, 1 / 2\n", []byte{0, 0, 0, 0, 0, 0, 0xf0, 0xff, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{".float 1.0 / 2\n", []byte{0, 0, 0, 0, 0, 0, 0xe0, 0x3f}},
+		{"EXIT .equ 3\nsyscall EXIT\n", []byte{0x70, 0x03}},
+		{"HALF .equ 0.5\n.float HALF * 3\n", []byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{"table: .byte 1, 2\nend: nop\nSIZE .equ end - table\n.byte SIZE\n", []byte{0x01, 0x02, 0x00, 0x02}},
+		{"jmp TARGET\nstart: halt\nTARGET .equ start\n", []byte{0x60, 0x05, 0, 0, 0, 0x01}},
+		{"N .set 1\n.byte N\nN .set N + 1\n.byte N\n", []byte{0x01, 0x02}},
+		{"NOP\nHalt\n.BYTE 1\n", []byte{0x00, 0x01, 0x01}},
+		{"jmp: JMP jmp\n", []byte{0x60, 0x00, 0, 0, 0}},
+		{"N .EQU 3\nsyscall N\n", []byte{0x70, 0x03}},
+		{".byte -0x10, -0b1, -0o7, 1-0x1\n", []byte{0xf0, 0xff, 0xf9, 0x00}},
+		{".int -0x8000000000000000\n", []byte{0, 0, 0, 0, 0, 0, 0, 0x80}},
+	}
+
+	for i, c := range testCases {
+		c.verify(t, i)
+	}
+}
+
+func TestEmitErrors(t *testing.T) {
+	testCases := []string{
+		"jump 1\n",                    // unknown opcode
+		"nop 1\n",                     // superfluous operand
+		"pushi\n",                     // missing operand
+		"pushi 1.5\n",                 // float instead of integer
+		"syscall 256\n",               // too big
+		"jmp -1\n",                    // negative address
+		"pushi 0x1ffffffffffffffff\n", // out of range
+		"pushi -0x8000000000000001\n", // out of range
+		"jmp nowhere\n",               // undefined label
+		"jmp 1, 2\n",                  // too many operands
+		".byte 256\n",                 // too big
+		".word 1.5\n",                 // float instead of integer
+		".bytes 1\n",                  // unknown directive
+		"syscall \"AB\"\n",            // string too long
+		"jmp \"A\"\n",                 // string as address
+		".float \"A\"\n",              // string as float
+		"pushi 1 / 0\n",               // division by zero
+		"pushi 1 % 0\n",               // division by zero
+		"pushi 1 << 64\n",             // shift out of range
+		"pushi 1.5 * 2\n",             // float instead of integer
+		"pushi ~1.5\n",                // float with integer operator
+		".float 1.5 | 1\n",            // float with integer operator
+		".byte \"A\" + 1\n",           // string in an expression
+		"jmp 1 - 2\n",                 // negative address
+		"jmp nowhere - 1\n",           // undefined label
+	}
+
+	for i, c := range testCases {
+		lexer := newLexer(c)
+		diagnostics := NewDiagnostics()
+		assemble(lexer, Options{}, diagnostics)
+		if diagnostics.err() == nil {
+			t.Errorf("CaseID %d: expected an error for \"%s\"", i, c)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package assembler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// - Value ----------------------------------------------------------------------------------------------------------------------
+
+// Value is the outcome of an expression, either an integer or a float
+type Value struct {
+	isFloat bool
+	integer int64
+	float   float64
+}
+
+// asFloat returns the value as a float, converting it if needed
+func (value Value) asFloat() float64 {
+	if value.isFloat {
+		return value.float
+	}
+	return float64(value.integer)
+}
+
+// String shows the value the way it would be written in the source code
+func (value Value) String() string {
+	if value.isFloat {
+		return strconv.FormatFloat(value.float, 'g', -1, 64)
+	}
+	return strconv.FormatInt(value.integer, 10)
+}
+
+func NewIntegerValue(integer int64) (value Value) {
+	value = Value{integer: integer}
+	return
+}
+
+func NewFloatValue(float float64) (value Value) {
+	value = Value{isFloat: true, float: float}
+	return
+}
+
+// - Expression -----------------------------------------------------------------------------------------------------------------
+
+// Expression is a node in the tree of a constant expression. It is either an operand, an operator with one or two
+// expressions to work on, or brackets around an expression.
+type Expression struct {
+	token Token       // the operand, the operator or the opening bracket
+	left  *Expression // the left hand side of a binary operator
+	right *Expression // the right hand side of a binary operator, the only side of a unary operator or brackets
+}
+
+// isOperand checks if the expression is just a single operand
+func (e *Expression) isOperand() bool {
+	return e.left == nil && e.right == nil
+}
+
+// start returns where the expression starts in the source code
+func (e *Expression) start() Position {
+	if e.left != nil {
+		return e.left.start()
+	}
+	return e.token.start
+}
+
+// eachToken calls visit for every token of the expression, from left to right
+func (e *Expression) eachToken(visit func(token *Token)) {
+	if e.left != nil {
+		e.left.eachToken(visit)
+	}
+	visit(&e.token)
+	if e.right != nil {
+		e.right.eachToken(visit)
+	}
+}
+
+// String shows the expression nicely formatted
+func (e *Expression) String() string {
+	switch {
+	case e.isOperand():
+		return e.token.String()
+	case e.token.token == TK_BRACKET_OPEN:
+		return "(" + e.right.String() + ")"
+	case e.left == nil:
+		return e.token.String() + e.right.String()
+	}
+	return e.left.String() + " " + e.token.String() + " " + e.right.String()
+}
+
+func NewOperand(token Token) (e *Expression) {
+	e = &Expression{token: token}
+	return
+}
+
+// - Expression Parser ----------------------------------------------------------------------------------------------------------
+
+// precedences of the binary operators, the higher the tighter they bind
+var precedences = map[int]int{
+	TK_PIPE:        1,
+	TK_CARET:       2,
+	TK_AMPERSAND:   3,
+	TK_SHIFT_LEFT:  4,
+	TK_SHIFT_RIGHT: 4,
+	TK_PLUS:        5,
+	TK_MINUS:       5,
+	TK_STAR:        6,
+	TK_SLASH:       6,
+	TK_PERCENT:     6,
+}
+
+// binaryOperator looks at the next token to see if it is a binary operator, a negative number is read as a
+// subtraction
+func (p *TokenStream) binaryOperator() (operator Token, ok bool) {
+	p.splitMinus()
+	operator = p.Peek(0)
+	_, ok = precedences[operator.token]
+	return
+}
+
+// parseOperand reads a single operand, a unary operator or an expression between brackets
+func (p *TokenStream) parseOperand() (e *Expression, err error) {
+	token := p.Peek(0)
+	switch {
+	case token.token == TK_MINUS || token.token == TK_PLUS || token.token == TK_TILDE:
+		p.Next()
+		e = &Expression{token: token}
+		e.right, err = p.parseOperand()
+	case token.token == TK_BRACKET_OPEN:
+		p.Next()
+		e = &Expression{token: token}
+		e.right, err = p.parseBinary(1)
+		if err != nil {
+			return
+		}
+		if p.Peek(0).token != TK_BRACKET_CLOSE {
+			err = NewSourceError(p.Peek(0).start, "expected ')', got '%s'", p.Peek(0).String())
+			return
+		}
+		p.Next()
+	case isOperand(token):
+		p.Next()
+		e = NewOperand(asName(token))
+	default:
+		err = NewSourceError(token.start, "expected operand, got '%s'", token.String())
+	}
+	return
+}
+
+// parseBinary reads operands separated by binary operators of at least the given precedence
+func (p *TokenStream) parseBinary(minimum int) (e *Expression, err error) {
+	e, err = p.parseOperand()
+	for err == nil {
+		operator, ok := p.binaryOperator()
+		if !ok || precedences[operator.token] < minimum {
+			return
+		}
+		p.Next()
+		left := e
+		e = &Expression{token: operator, left: left}
+		e.right, err = p.parseBinary(precedences[operator.token] + 1)
+	}
+	return
+}
+
+// parseExpression reads a complete expression
+func (p *TokenStream) parseExpression() (e *Expression, err error) {
+	e, err = p.parseBinary(1)
+	return
+}
+
+// qualify replaces the names of local and anonymous labels by their full names
+func (e *Expression) qualify(scope *Scope) (err error) {
+	if e.isOperand() {
+		if e.token.token == TK_IDENTIFIER {
+			var name string
+			name, err = scope.resolve(e.token)
+			e.token = e.token.named(name)
+			err = atPosition(err, e.token.start)
+		}
+		return
+	}
+	if e.left != nil {
+		err = e.left.qualify(scope)
+		if err != nil {
+			return
+		}
+	}
+	err = e.right.qualify(scope)
+	return
+}
+
+// - Evaluator ------------------------------------------------------------------------------------------------------------------
+
+// literalValue determines the value of a single operand, labels are resolved through the symbol table
+func literalValue(token Token, symbols SymbolTable) (value Value, err error) {
+	switch token.token {
+	case TK_IDENTIFIER:
+		value, err = symbols.resolve(token.Value())
+	case TK_FLOAT:
+		value.isFloat = true
+		value.float, err = floatValue(token)
+	case TK_STRING:
+		err = fmt.Errorf("a string can not be used in an expression")
+	default:
+		value.integer, err = integerValue(token)
+	}
+	return
+}
+
+// applyUnary calculates the outcome of a unary operator
+func applyUnary(operator Token, operand Value) (value Value, err error) {
+	switch {
+	case operator.token == TK_PLUS:
+		value = operand
+	case operator.token == TK_MINUS && operand.isFloat:
+		value = NewFloatValue(-operand.float)
+	case operator.token == TK_MINUS && operand.integer == math.MinInt64:
+		err = fmt.Errorf("integer overflow in '%s'", operator.String())
+	case operator.token == TK_MINUS:
+		value = NewIntegerValue(-operand.integer)
+	case operand.isFloat:
+		err = fmt.Errorf("operator '%s' needs an integer", operator.String())
+	default:
+		value = NewIntegerValue(^operand.integer)
+	}
+	return
+}
+
+// applyFloat calculates the outcome of a binary operator on floats
+func applyFloat(operator Token, left float64, right float64) (value Value, err error) {
+	switch operator.token {
+	case TK_PLUS:
+		value = NewFloatValue(left + right)
+	case TK_MINUS:
+		value = NewFloatValue(left - right)
+	case TK_STAR:
+		value = NewFloatValue(left * right)
+	case TK_SLASH:
+		if right == 0 {
+			err = fmt.Errorf("division by zero")
+			return
+		}
+		value = NewFloatValue(left / right)
+	default:
+		err = fmt.Errorf("operator '%s' needs integers", operator.String())
+		return
+	}
+	// infinity is fine as an input, but it should not come out of finite numbers
+	if math.IsInf(value.float, 0) && !math.IsInf(left, 0) && !math.IsInf(right, 0) {
+		err = fmt.Errorf("float overflow in '%s'", operator.String())
+	}
+	return
+}
+
+// overflows checks if a binary operator on integers does not fit in 64 bits. A shift to the left may also fill up the
+// bits of an unsigned number, as integers fit either as signed or as unsigned.
+func overflows(operator Token, left int64, right int64) bool {
+	switch operator.token {
+	case TK_PLUS:
+		return (right > 0 && left > math.MaxInt64-right) || (right < 0 && left < math.MinInt64-right)
+	case TK_MINUS:
+		return (right < 0 && left > math.MaxInt64+right) || (right > 0 && left < math.MinInt64+right)
+	case TK_STAR:
+		product := left * right
+		return left != 0 && (product/left != right || (left == -1 && right == math.MinInt64))
+	case TK_SLASH:
+		return left == math.MinInt64 && right == -1
+	case TK_SHIFT_LEFT:
+		signed := (left<<uint(right))>>uint(right) == left
+		unsigned := left >= 0 && (uint64(left)<<uint(right))>>uint(right) == uint64(left)
+		return !signed && !unsigned
+	}
+	return false
+}
+
+// applyInteger calculates the outcome of a binary operator on integers
+func applyInteger(operator Token, left int64, right int64) (value Value, err error) {
+	switch operator.token {
+	case TK_SLASH, TK_PERCENT:
+		if right == 0 {
+			err = fmt.Errorf("division by zero")
+			return
+		}
+	case TK_SHIFT_LEFT, TK_SHIFT_RIGHT:
+		if right < 0 || right > 63 {
+			err = fmt.Errorf("shift by %d out of range", right)
+			return
+		}
+	}
+	if overflows(operator, left, right) {
+		err = fmt.Errorf("integer overflow in '%s'", operator.String())
+		return
+	}
+
+	switch operator.token {
+	case TK_PLUS:
+		value = NewIntegerValue(left + right)
+	case TK_MINUS:
+		value = NewIntegerValue(left - right)
+	case TK_STAR:
+		value = NewIntegerValue(left * right)
+	case TK_SLASH:
+		value = NewIntegerValue(left / right)
+	case TK_PERCENT:
+		value = NewIntegerValue(left % right)
+	case TK_SHIFT_LEFT:
+		value = NewIntegerValue(left << uint(right))
+	case TK_SHIFT_RIGHT:
+		value = NewIntegerValue(left >> uint(right))
+	case TK_AMPERSAND:
+		value = NewIntegerValue(left & right)
+	case TK_PIPE:
+		value = NewIntegerValue(left | right)
+	case TK_CARET:
+		value = NewIntegerValue(left ^ right)
+	}
+	return
+}
+
+// evaluate calculates the value of the expression, labels are resolved through the symbol table. Labels defined
+// further down in the source code are only known after the first pass, so the byte code is generated in the second pass
+// once every label has its address.
+func (e *Expression) evaluate(symbols SymbolTable) (value Value, err error) {
+	defer func() {
+		err = atPosition(err, e.token.start)
+	}()
+
+	// a single operand
+	if e.isOperand() {
+		value, err = literalValue(e.token, symbols)
+		return
+	}
+
+	// brackets and unary operators
+	right, err := e.right.evaluate(symbols)
+	if err != nil {
+		return
+	}
+	if e.token.token == TK_BRACKET_OPEN {
+		value = right
+		return
+	}
+	if e.left == nil {
+		value, err = applyUnary(e.token, right)
+		return
+	}
+
+	// binary operators
+	left, err := e.left.evaluate(symbols)
+	if err != nil {
+		return
+	}
+	if left.isFloat || right.isFloat {
+		value, err = applyFloat(e.token, left.asFloat(), right.asFloat())
+		return
+	}
+	value, err = applyInteger(e.token, left.integer, right.integer)
+	return
+}
@@ -0,0 +1,114 @@
+package assembler
+
+import (
+	"testing"
+)
+
+// - Support functions to prevent repetition ------------------------------------------------------------------------------------
+
+type ExpressionCase struct {
+	sourceCode    string
+	expectedTree  string
+	expectedValue string
+}
+
+// parseOperand parses the first operand of a single line of source code
+func parseOperand(t *testing.T, source string) (operand *Expression) {
+	lexer := newLexer(source)
+
+	diagnostics := NewDiagnostics()
+	lines := parse(lexer, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Errorf("%s", err.Error())
+		return
+	}
+	if len(lines) != 1 || len(lines[0].operands) != 1 {
+		t.Errorf("expected a single line with one operand for \"%s\"", source)
+		return
+	}
+	operand = lines[0].operands[0]
+	return
+}
+
+func (c ExpressionCase) verify(t *testing.T, caseId int) {
+	operand := parseOperand(t, c.sourceCode)
+	if operand == nil {
+		return
+	}
+	if operand.String() != c.expectedTree {
+		t.Errorf("CaseID %d: wrong tree, expected \"%s\", got \"%s\"", caseId, c.expectedTree, operand.String())
+	}
+
+	symbols := NewSymbolTable()
+	symbols.define("start", 16, NewPosition(""))
+	value, err := operand.evaluate(symbols)
+	if err != nil {
+		t.Errorf("CaseID %d: %s", caseId, err.Error())
+		return
+	}
+	if value.String() != c.expectedValue {
+		t.Errorf("CaseID %d: wrong value, expected %s, got %s", caseId, c.expectedValue, value.String())
+	}
+}
+
+// - Test Expressions -----------------------------------------------------------------------------------------------------------
+
+func TestExpression(t *testing.T) {
+	testCases := []ExpressionCase{
+		{"pushi 1\n", "1", "1"},
+		{"pushi 1 + 2 * 3\n", "1 + 2 * 3", "7"},
+		{"pushi (1 + 2) * 3\n", "(1 + 2) * 3", "9"},
+		{"pushi 10 - 4 - 3\n", "10 - 4 - 3", "3"},
+		{"pushi 5 -3\n", "5 - 3", "2"},
+		{"pushi -3 * -2\n", "-3 * -2", "6"},
+		{"pushi -(1 + 2)\n", "-(1 + 2)", "-3"},
+		{"pushi ~0 & 0xff\n", "~0 & 0xff", "255"},
+		{"pushi 1 | 2 ^ 3 & 4 << 1 + 1\n", "1 | 2 ^ 3 & 4 << 1 + 1", "3"},
+		{"pushi 1 << 4 >> 2\n", "1 << 4 >> 2", "4"},
+		{"pushi -7 / 2\n", "-7 / 2", "-3"},
+		{"pushi -7 % 2\n", "-7 % 2", "-1"},
+		{"pushi start + 4\n", "start + 4", "20"},
+		{"pushi 'A' + 1\n", "'A' + 1", "66"},
+		{"pushf 1.5 * 2\n", "1.5 * 2", "3"},
+		{"pushf 1 / 4.0\n", "1 / 4.0", "0.25"},
+		{"pushf -inf\n", "-inf", "-Inf"},
+		{"pushf inf * 2\n", "inf * 2", "+Inf"},
+	}
+
+	for i, c := range testCases {
+		c.verify(t, i)
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	testCases := []struct {
+		sourceCode    string
+		expectedError string
+	}{
+		{"pushi 1 / 0\n", "1:9: division by zero"},
+		{"pushi 2 * (3 % 0)\n", "1:14: division by zero"},
+		{"pushi 1 << -1\n", "1:9: shift by -1 out of range"},
+		{".int 9223372036854775807 + 1\n", "1:26: integer overflow in '+'"},
+		{".int -9223372036854775807 - 2\n", "1:27: integer overflow in '-'"},
+		{".int 4294967296 * 4294967296\n", "1:17: integer overflow in '*'"},
+		{".int 3 << 63\n", "1:8: integer overflow in '<<'"},
+		{".int -(-9223372036854775807 - 1)\n", "1:6: integer overflow in '-'"},
+		{".float 1e308 * 10\n", "1:14: float overflow in '*'"},
+		{".float -1e308 - 1e308\n", "1:15: float overflow in '-'"},
+		{"pushi 1 + nowhere\n", "1:11: undefined symbol \"nowhere\""},
+		{"pushi ~1.5\n", "1:7: operator '~' needs an integer"},
+		{"pushi 1.5 & 1\n", "1:11: operator '&' needs integers"},
+		{"pushi \"A\" + 1\n", "1:7: a string can not be used in an expression"},
+	}
+
+	for i, c := range testCases {
+		operand := parseOperand(t, c.sourceCode)
+		if operand == nil {
+			continue
+		}
+		_, err := operand.evaluate(NewSymbolTable())
+		if err == nil || err.Error() != c.expectedError {
+			t.Errorf("CaseID %d: wrong error, expected \"%s\", got \"%v\"", i, c.expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package assembler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// - Keywords -------------------------------------------------------------------------------------------------------------------
+
+// registers of the virtual machine. It is a stack machine, so there are none yet, but the tokenizer is ready for them.
+var registers = []string{}
+
+// directiveNames returns the names of all directives: the data definitions, the constants and the preprocessor ones
+func directiveNames() (names []string) {
+	for _, directive := range directives {
+		names = append(names, directive.name)
+	}
+	for name := range assignments {
+		names = append(names, name)
+	}
+	for name := range preprocessorDirectives {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// mnemonics returns the mnemonics of all opcodes
+func mnemonics() (names []string) {
+	for _, opcode := range opcodes {
+		names = append(names, opcode.mnemonic)
+	}
+	return
+}
+
+// keywords maps the lower case names of the mnemonics, directives and registers to their token
+var keywords = keywordTable()
+
+// KEYWORD_MAX_LENGTH is longer than any keyword, longer names need not be looked up
+const KEYWORD_MAX_LENGTH = 16
+
+// keywordTable classifies all keywords, a mnemonic wins from a directive or register with the same name
+func keywordTable() (table map[string]int) {
+	table = make(map[string]int)
+	for _, name := range registers {
+		table[strings.ToLower(name)] = TK_REGISTER
+	}
+	for _, name := range directiveNames() {
+		table[strings.ToLower(name)] = TK_DIRECTIVE
+	}
+	for _, name := range mnemonics() {
+		table[strings.ToLower(name)] = TK_MNEMONIC
+	}
+	return
+}
+
+// keyword classifies an identifier as a mnemonic, directive or register, ignoring case. Anything else is just an
+// identifier. The name is turned into lower case on the stack, so looking it up does not allocate anything.
+func keyword(name string) int {
+	if len(name) > KEYWORD_MAX_LENGTH {
+		return TK_IDENTIFIER
+	}
+	var buffer [KEYWORD_MAX_LENGTH]byte
+	lower := buffer[:len(name)]
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	if token, ok := keywords[string(lower)]; ok {
+		return token
+	}
+	return TK_IDENTIFIER
+}
+
+// isKeyword checks if the name is an opcode, directive or register, those should not be used for anything else
+func isKeyword(name string) bool {
+	return keyword(name) != TK_IDENTIFIER
+}
+
+// isDirective checks if the line starts with the given directive
+func isDirective(tokens []Token, name string) bool {
+	return len(tokens) > 0 && tokens[0].token == TK_DIRECTIVE && strings.EqualFold(tokens[0].Value(), name)
+}
+
+// - Suggestions ----------------------------------------------------------------------------------------------------------------
+
+// distance counts the number of characters to insert, delete or replace, or neighbours to swap, to turn one word into
+// the other, ignoring case. Swapping two characters is the most common typo, so it counts as a single edit.
+func distance(word string, other string) int {
+	a, b := []rune(strings.ToLower(word)), []rune(strings.ToLower(other))
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if d[i-1][j]+1 < d[i][j] {
+				d[i][j] = d[i-1][j] + 1
+			}
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// suggest looks for the name that comes closest to the misspelled one, at most a third of the characters may differ
+func suggest(name string, names []string) (suggestion string, ok bool) {
+	best := len([]rune(name))/3 + 1
+	for _, candidate := range names {
+		if d := distance(name, candidate); d < best {
+			suggestion, best, ok = candidate, d, true
+		}
+	}
+	return
+}
+
+// unknownOpcode explains that the opcode is not known, suggesting what it might have been
+func unknownOpcode(name string) (err error) {
+	kind, names := "opcode", mnemonics()
+	if strings.HasPrefix(name, ".") {
+		kind, names = "directive", directiveNames()
+	}
+	if suggestion, ok := suggest(name, names); ok {
+		err = fmt.Errorf("unknown %s \"%s\", did you mean \"%s\"?", kind, name, suggestion)
+		return
+	}
+	err = fmt.Errorf("unknown %s \"%s\"", kind, name)
+	return
+}
@@ -0,0 +1,94 @@
+package assembler
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// - Listing --------------------------------------------------------------------------------------------------------------------
+
+const LISTING_BYTES_PER_ROW = 8 // number of bytes shown on one row of the listing
+
+// hexBytes shows the bytes in hexadecimal, separated by spaces
+func hexBytes(code []byte) string {
+	digits := make([]string, len(code))
+	for i, b := range code {
+		digits[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(digits, " ")
+}
+
+// ListingLine is what the listing keeps of a line of source code, its byte code is part of the code of the program
+type ListingLine struct {
+	number  int    // the line number in the source code
+	address int64  // address of the generated byte code
+	size    int64  // the number of bytes of byte code
+	text    string // the line nicely formatted
+}
+
+func NewListingLine(line Line, size int64) (listingLine ListingLine) {
+	listingLine = ListingLine{number: line.position().line, address: line.address, size: size, text: line.String()}
+	return
+}
+
+// writeLine writes a line of the listing: the line number, the address, the byte code and the formatted source code.
+// If the byte code does not fit on a single row, the remainder is continued on the rows below.
+func writeLine(w io.Writer, line ListingLine, code []byte) (err error) {
+	lineCode := code[line.address : line.address+line.size]
+	row := lineCode
+	if len(row) > LISTING_BYTES_PER_ROW {
+		row = row[:LISTING_BYTES_PER_ROW]
+	}
+	_, err = fmt.Fprintf(w, "%5d  %04X  %-23s  %s\n", line.number, line.address, hexBytes(row), line.text)
+
+	for offset := LISTING_BYTES_PER_ROW; err == nil && offset < len(lineCode); offset += LISTING_BYTES_PER_ROW {
+		row = lineCode[offset:]
+		if len(row) > LISTING_BYTES_PER_ROW {
+			row = row[:LISTING_BYTES_PER_ROW]
+		}
+		_, err = fmt.Fprintf(w, "%5s  %04X  %s\n", "", line.address+int64(offset), hexBytes(row))
+	}
+	return
+}
+
+// writeSymbols writes the symbol table, sorted by name
+func writeSymbols(w io.Writer, symbols SymbolTable) (err error) {
+	names := make([]string, 0, len(symbols))
+	for name := range symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	_, err = fmt.Fprintf(w, "Symbols:\n")
+	for _, name := range names {
+		if err != nil {
+			return
+		}
+		symbol := symbols[name]
+		value := fmt.Sprintf("%04X", symbol.value.integer)
+		if symbol.value.isFloat {
+			value = symbol.value.String()
+		}
+		_, err = fmt.Fprintf(w, "%-32s  %4s  %s\n", symbol.name, value, symbol.where.String())
+	}
+	return
+}
+
+// writeListing writes the assembly listing: every line side by side with its address and byte code, followed by the
+// symbol table.
+func writeListing(w io.Writer, lines []ListingLine, code []byte, symbols SymbolTable) (err error) {
+	for _, line := range lines {
+		err = writeLine(w, line, code)
+		if err != nil {
+			return
+		}
+	}
+	_, err = fmt.Fprintln(w)
+	if err != nil {
+		return
+	}
+	err = writeSymbols(w, symbols)
+	return
+}
@@ -0,0 +1,48 @@
+package assembler
+
+import (
+	"bytes"
+	"testing"
+)
+
+// - Test Listing ---------------------------------------------------------------------------------------------------------------
+
+func TestHexBytes(t *testing.T) {
+	if hexBytes([]byte{0x0a, 0xff, 0x00}) != "0A FF 00" {
+		t.Errorf("wrong hex bytes, expected \"0A FF 00\", got \"%s\"", hexBytes([]byte{0x0a, 0xff, 0x00}))
+	}
+	if hexBytes([]byte{}) != "" {
+		t.Errorf("wrong hex bytes, expected \"\", got \"%s\"", hexBytes([]byte{}))
+	}
+}
+
+func TestWriteListing(t *testing.T) {
+	lexer := newLexer("start: pushi 5\n// comment\nloop:   jmp start\n  halt\nHALF .equ 0.5\n")
+
+	diagnostics := NewDiagnostics()
+	lines, symbols, code := assemble(lexer, Options{}, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+
+	var listing bytes.Buffer
+	err := writeListing(&listing, lines, code, symbols)
+	if err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+
+	expected := "" +
+		"    1  0000  10 05 00 00 00 00 00 00  start:          pushi 5\n" +
+		"       0008  00\n" +
+		"    3  0009  60 00 00 00 00           loop:           jmp start\n" +
+		"    4  000E  01                                       halt\n" +
+		"    5  000F                           HALF            .equ 0.5\n" +
+		"\n" +
+		"Symbols:\n" +
+		"HALF                               0.5  5:1\n" +
+		"loop                              0009  3:1\n" +
+		"start                             0000  1:1\n"
+	if listing.String() != expected {
+		t.Errorf("wrong listing, expected:\n%s\ngot:\n%s", expected, listing.String())
+	}
+}
@@ -0,0 +1,90 @@
+package assembler
+
+import (
+	"strings"
+)
+
+// - Opcode ---------------------------------------------------------------------------------------------------------------------
+
+const (
+	OT_NONE    = iota // No operand
+	OT_INTEGER        // Integer immediate, signed or unsigned
+	OT_FLOAT          // Floating point immediate
+	OT_ADDRESS        // Address in the program, a jump target or a variable
+)
+
+// Opcode describes a single instruction of the virtual machine, its operand is stored little-endian directly after the
+// opcode itself.
+type Opcode struct {
+	mnemonic string
+	code     byte
+	operand  int // the kind of operand, OT_...
+	width    int // the width of the operand in bytes
+}
+
+// size returns the number of bytes the instruction takes up in the byte code
+func (opcode Opcode) size() int {
+	return 1 + opcode.width
+}
+
+// opcodes is the instruction set of the virtual machine
+var opcodes = []Opcode{
+	// Machine control
+	{"nop", 0x00, OT_NONE, 0},
+	{"halt", 0x01, OT_NONE, 0},
+	// Stack manipulation
+	{"pushi", 0x10, OT_INTEGER, 8},
+	{"pushf", 0x11, OT_FLOAT, 8},
+	{"pop", 0x12, OT_NONE, 0},
+	{"dup", 0x13, OT_NONE, 0},
+	{"swap", 0x14, OT_NONE, 0},
+	// Memory access
+	{"load", 0x20, OT_ADDRESS, 4},
+	{"store", 0x21, OT_ADDRESS, 4},
+	// Integer arithmetic
+	{"add", 0x30, OT_NONE, 0},
+	{"sub", 0x31, OT_NONE, 0},
+	{"mul", 0x32, OT_NONE, 0},
+	{"div", 0x33, OT_NONE, 0},
+	{"mod", 0x34, OT_NONE, 0},
+	{"neg", 0x35, OT_NONE, 0},
+	// Floating point arithmetic
+	{"fadd", 0x38, OT_NONE, 0},
+	{"fsub", 0x39, OT_NONE, 0},
+	{"fmul", 0x3A, OT_NONE, 0},
+	{"fdiv", 0x3B, OT_NONE, 0},
+	// Bitwise operations
+	{"and", 0x40, OT_NONE, 0},
+	{"or", 0x41, OT_NONE, 0},
+	{"xor", 0x42, OT_NONE, 0},
+	{"not", 0x43, OT_NONE, 0},
+	{"shl", 0x44, OT_NONE, 0},
+	{"shr", 0x45, OT_NONE, 0},
+	// Comparison
+	{"eq", 0x50, OT_NONE, 0},
+	{"ne", 0x51, OT_NONE, 0},
+	{"lt", 0x52, OT_NONE, 0},
+	{"le", 0x53, OT_NONE, 0},
+	{"gt", 0x54, OT_NONE, 0},
+	{"ge", 0x55, OT_NONE, 0},
+	// Flow control
+	{"jmp", 0x60, OT_ADDRESS, 4},
+	{"jz", 0x61, OT_ADDRESS, 4},
+	{"jnz", 0x62, OT_ADDRESS, 4},
+	{"call", 0x63, OT_ADDRESS, 4},
+	{"ret", 0x64, OT_NONE, 0},
+	// Operating system
+	{"syscall", 0x70, OT_INTEGER, 1},
+}
+
+// findOpcode looks up the opcode for a mnemonic
+func findOpcode(mnemonic string) (opcode Opcode, ok bool) {
+	for _, opcode = range opcodes {
+		if strings.EqualFold(opcode.mnemonic, mnemonic) {
+			ok = true
+			return
+		}
+	}
+	opcode = Opcode{}
+	return
+}
@@ -0,0 +1,327 @@
+package assembler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// - Line -----------------------------------------------------------------------------------------------------------------------
+
+// Line is a single line of source code, broken down into `<label>: <opcode> [<expression>{, <expression>}]`
+type Line struct {
+	address  int64         // address of the generated byte code
+	label    Token         // optional, TK_UNKNOWN if there is no label
+	opcode   Token         // the opcode or directive identifier
+	operands []*Expression // optional, instructions take at most one, data directives a list
+}
+
+// position returns where the line starts in the source code
+func (line Line) position() Position {
+	if line.label.token != TK_UNKNOWN {
+		return line.label.start
+	}
+	return line.opcode.start
+}
+
+// String shows the line nicely formatted
+func (line Line) String() string {
+	label := ""
+	if line.label.token != TK_UNKNOWN && isAssignment(line.opcode.Value()) {
+		label = line.label.Value()
+	} else if line.label.token != TK_UNKNOWN {
+		label = line.label.Value() + ":"
+	}
+	s := fmt.Sprintf("%-16s%s", label, line.opcode.Value())
+	for i, operand := range line.operands {
+		if i == 0 {
+			s += " " + operand.String()
+		} else {
+			s += ", " + operand.String()
+		}
+	}
+	return s
+}
+
+// eachToken calls visit for the label, the opcode and every token of the operands
+func (line *Line) eachToken(visit func(token *Token)) {
+	visit(&line.label)
+	visit(&line.opcode)
+	for _, operand := range line.operands {
+		operand.eachToken(visit)
+	}
+}
+
+// detach copies the text of the tokens out of the source code into a single buffer of the line, so a line that is kept
+// for the second pass does not keep the source code it was read from in memory
+func (line *Line) detach() {
+	size := 0
+	line.eachToken(func(token *Token) { size += len(token.text) })
+	buffer := make([]byte, 0, size)
+	line.eachToken(func(token *Token) { *token, buffer = token.copyText(buffer) })
+}
+
+func NewLine() (line Line) {
+	line = Line{label: NewToken(), opcode: NewToken(), operands: []*Expression{}}
+	return
+}
+
+// isAssignment checks if the opcode defines a constant instead of generating byte code
+func isAssignment(opcode string) bool {
+	_, ok := assignments[strings.ToLower(opcode)]
+	return ok
+}
+
+// - Line Tokens ----------------------------------------------------------------------------------------------------------------
+
+// readLine reads all tokens up to the end of the line or file, the TK_END_OF_LINE or TK_END_OF_FILE itself is not part
+// of the result. The tokens are only valid up to the next call, whoever keeps them longer has to copy them.
+func (l *Lexer) readLine() (tokens []Token, err error) {
+	tokens = l.line[:0]
+	defer func() { l.line = tokens }()
+	for {
+		var token Token
+		token, err = l.NextToken()
+		if err != nil || token.token == TK_END_OF_LINE || token.token == TK_END_OF_FILE {
+			return
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+// isOperand checks if the token can be used as an operand
+func isOperand(token Token) bool {
+	switch token.token {
+	case TK_IDENTIFIER, TK_INTEGER, TK_HEXADECIMAL, TK_BINARY, TK_OCTAL, TK_FLOAT, TK_STRING, TK_CHAR:
+		return true
+	}
+	return isName(token)
+}
+
+// isName checks if the token can be the name of a label. Using a mnemonic or directive as label is allowed, so
+// `nop: jmp nop` is fine, albeit confusing.
+func isName(token Token) bool {
+	return token.token == TK_IDENTIFIER || token.token == TK_MNEMONIC || token.token == TK_DIRECTIVE
+}
+
+// asName turns a keyword token into the identifier of a label
+func asName(token Token) Token {
+	if isName(token) {
+		token.token = TK_IDENTIFIER
+	}
+	return token
+}
+
+// - Token Stream ---------------------------------------------------------------------------------------------------------------
+
+const (
+	SG_NONE   = iota // the next token is read as it is
+	SG_MINUS         // the next token is a negative number, read as a minus first
+	SG_NUMBER        // the minus has been read, the number follows without its sign
+)
+
+// TokenStream walks through the tokens of a single line. All tokens of the line are known, so the parser can look ahead
+// as far as it needs and return to an earlier mark to try another way of reading the line.
+type TokenStream struct {
+	tokens []Token
+	next   int // the index of the next token to read
+	sign   int // how the sign of the next token is read, SG_...
+}
+
+// Checkpoint is a place in the token stream to return to
+type Checkpoint struct {
+	next int
+	sign int
+}
+
+// AtEnd checks if all tokens of the line have been read
+func (p *TokenStream) AtEnd() bool {
+	return p.next >= len(p.tokens)
+}
+
+// Peek returns the token n tokens ahead without reading it, Peek(0) is the next token and a negative n is taken as 0.
+// Beyond the end of the line it is a TK_END_OF_LINE.
+func (p *TokenStream) Peek(n int) Token {
+	if n < 0 {
+		n = 0
+	}
+	index := p.next + n
+	if p.sign == SG_MINUS {
+		if n == 0 {
+			minus, _ := splitSign(p.tokens[p.next])
+			return minus
+		}
+		index--
+	}
+	if index >= len(p.tokens) {
+		token := NewToken()
+		token.token = TK_END_OF_LINE
+		if len(p.tokens) > 0 {
+			token.start = p.tokens[len(p.tokens)-1].end
+			token.end = token.start
+		}
+		return token
+	}
+	if p.sign != SG_NONE && index == p.next {
+		_, number := splitSign(p.tokens[index])
+		return number
+	}
+	return p.tokens[index]
+}
+
+// Next reads the next token
+func (p *TokenStream) Next() (token Token) {
+	token = p.Peek(0)
+	switch {
+	case p.sign == SG_MINUS:
+		p.sign = SG_NUMBER
+	case !p.AtEnd():
+		p.next++
+		p.sign = SG_NONE
+	}
+	return
+}
+
+// Mark returns a checkpoint to return to with Reset, it stays valid for as long as the stream is used
+func (p *TokenStream) Mark() Checkpoint {
+	return Checkpoint{next: p.next, sign: p.sign}
+}
+
+// Reset backtracks to a checkpoint, the tokens read since are read again
+func (p *TokenStream) Reset(mark Checkpoint) {
+	p.next, p.sign = mark.next, mark.sign
+}
+
+// splitMinus reads the next token as a minus followed by a positive number, if it is a negative number. The tokenizer
+// reads `-3` as a negative number, where an operator is expected that is a subtraction instead.
+func (p *TokenStream) splitMinus() {
+	if p.sign != SG_NONE || p.AtEnd() {
+		return
+	}
+	token := p.tokens[p.next]
+	switch token.token {
+	case TK_INTEGER, TK_FLOAT, TK_HEXADECIMAL, TK_BINARY, TK_OCTAL:
+		if len(token.text) > 1 && token.text[0] == '-' {
+			p.sign = SG_MINUS
+		}
+	}
+}
+
+// splitSign splits a negative number into its minus and the positive number
+func splitSign(token Token) (minus Token, number Token) {
+	minus = Token{token: TK_MINUS, start: token.start, end: token.start}
+	minus.end.column++
+	minus.end.offset++
+	number = token
+	number.text = token.text[1:]
+	number.start = minus.end
+	return
+}
+
+func NewTokenStream(tokens []Token) (p *TokenStream) {
+	p = &TokenStream{tokens: tokens}
+	return
+}
+
+// parseLine follows the grammar `[<label>:] <opcode> [<expression>{, <expression>}]` to turn the tokens into a Line
+func parseLine(tokens []Token) (line Line, err error) {
+	line = NewLine()
+	p := NewTokenStream(tokens)
+
+	// an optional label, or the name of a constant which goes without a colon, otherwise the line starts over
+	mark := p.Mark()
+	label := p.Next()
+	if isName(label) && p.Peek(0).token == TK_COLON {
+		line.label = asName(label)
+		p.Next()
+	} else if isName(label) && p.Peek(0).token == TK_DIRECTIVE && isAssignment(p.Peek(0).Value()) {
+		line.label = asName(label)
+	} else {
+		p.Reset(mark)
+	}
+
+	// the opcode is mandatory
+	if p.AtEnd() {
+		err = NewSourceError(p.Peek(0).start, "missing opcode after label \"%s\"", line.label.Value())
+		return
+	}
+	if !isName(p.Peek(0)) {
+		err = NewSourceError(p.Peek(0).start, "expected opcode, got '%s'", p.Peek(0).String())
+		return
+	}
+	line.opcode = p.Next()
+
+	// the operands are optional, separated by commas
+	for !p.AtEnd() {
+		var operand *Expression
+		operand, err = p.parseExpression()
+		if err != nil {
+			return
+		}
+		line.operands = append(line.operands, operand)
+
+		if p.AtEnd() {
+			break
+		}
+		if isOperand(p.Peek(0)) {
+			err = NewSourceError(p.Peek(0).start, "missing ',' between operands, got '%s'", p.Peek(0).String())
+			return
+		}
+		if p.Peek(0).token != TK_COMMA {
+			err = NewSourceError(p.Peek(0).start, "unexpected '%s' after operand", p.Peek(0).String())
+			return
+		}
+		p.Next()
+		if p.AtEnd() {
+			err = NewSourceError(p.Peek(0).start, "missing operand after ','")
+			return
+		}
+	}
+	return
+}
+
+// - Parser ---------------------------------------------------------------------------------------------------------------------
+
+// Parser reads the source code line by line, through the preprocessor, and turns it into Lines. A line with an error
+// is skipped, so all errors in the source code are reported in one go.
+type Parser struct {
+	preprocessor *Preprocessor
+	diagnostics  *Diagnostics
+}
+
+// nextLine returns the next line, empty lines are skipped. At the end of the source code ok is false.
+func (p *Parser) nextLine() (line Line, ok bool) {
+	for {
+		tokens, more := p.preprocessor.nextLine()
+		if !more {
+			return
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+
+		line, err := parseLine(tokens)
+		if err != nil {
+			p.diagnostics.add(err)
+			continue
+		}
+		return line, true
+	}
+}
+
+// NewParser creates a parser for the source code, conditional assembly is evaluated against the symbols
+func NewParser(lexer *Lexer, options Options, symbols SymbolTable, diagnostics *Diagnostics) (p *Parser) {
+	p = &Parser{preprocessor: NewPreprocessor(lexer, options, symbols, diagnostics), diagnostics: diagnostics}
+	return
+}
+
+// parse reads all lines of the source code, without a first pass to fill in the symbols
+func parse(lexer *Lexer, diagnostics *Diagnostics) (lines []Line) {
+	parser := NewParser(lexer, Options{}, NewSymbolTable(), diagnostics)
+	for {
+		line, ok := parser.nextLine()
+		if !ok {
+			return
+		}
+		lines = append(lines, line)
+	}
+}
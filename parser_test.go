@@ -0,0 +1,243 @@
+package assembler
+
+import (
+	"testing"
+)
+
+// - Support functions to prevent repetition ------------------------------------------------------------------------------------
+
+type ParserCase struct {
+	sourceCode      string
+	expectedLabel   string
+	expectedOpcode  string
+	expectedOperand int
+	expectedValue   string
+}
+
+func (c ParserCase) verify(t *testing.T, caseId int) {
+	lexer := newLexer(c.sourceCode)
+
+	diagnostics := NewDiagnostics()
+	lines := parse(lexer, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Errorf("CaseID %d: %s", caseId, err.Error())
+		return
+	}
+	if len(lines) != 1 {
+		t.Errorf("CaseID %d: expected 1 line, got %d", caseId, len(lines))
+		return
+	}
+	line := lines[0]
+	if line.label.Value() != c.expectedLabel {
+		t.Errorf("CaseID %d: wrong label, expected \"%s\", got \"%s\"", caseId, c.expectedLabel, line.label.Value())
+	}
+	if line.opcode.Value() != c.expectedOpcode {
+		t.Errorf("CaseID %d: wrong opcode, expected \"%s\", got \"%s\"", caseId, c.expectedOpcode, line.opcode.Value())
+	}
+	operand := NewToken()
+	if len(line.operands) > 0 {
+		operand = line.operands[0].token
+	}
+	if operand.token != c.expectedOperand {
+		t.Errorf("CaseID %d: wrong operand, expected %d, got %d", caseId, c.expectedOperand, operand.token)
+	}
+	if operand.Value() != c.expectedValue {
+		t.Errorf("CaseID %d: wrong value, expected \"%s\", got \"%s\"", caseId, c.expectedValue, operand.Value())
+	}
+}
+
+// - Test Token Stream ----------------------------------------------------------------------------------------------------------
+
+func TestTokenStream(t *testing.T) {
+	tokens, err := newLexer("load x, 1\n").readLine()
+	if err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	stream := NewTokenStream(tokens)
+
+	expected := []int{TK_MNEMONIC, TK_IDENTIFIER, TK_COMMA, TK_INTEGER, TK_END_OF_LINE, TK_END_OF_LINE}
+	for n, e := range expected {
+		if token := stream.Peek(n); token.token != e {
+			t.Errorf("CaseID %d: wrong token, expected %d, got %d", n, e, token.token)
+		}
+	}
+	if end := stream.Peek(10); end.start != tokens[3].end {
+		t.Errorf("wrong position of the end of line, expected %v, got %v", tokens[3].end, end.start)
+	}
+
+	stream.Next()
+	mark := stream.Mark()
+	for !stream.AtEnd() {
+		stream.Next()
+	}
+	if token := stream.Next(); token.token != TK_END_OF_LINE {
+		t.Errorf("wrong token after the end, expected %d, got %d", TK_END_OF_LINE, token.token)
+	}
+	stream.Reset(mark)
+	if token := stream.Next(); token.token != TK_IDENTIFIER || token.Value() != "x" {
+		t.Errorf("expected to read \"x\" again after the reset, got '%s'", token.String())
+	}
+	if stream.Peek(-1).start != stream.Peek(0).start {
+		t.Errorf("expected Peek(-1) to be the next token")
+	}
+}
+
+func TestTokenStreamSplit(t *testing.T) {
+	tokens, _ := newLexer("1 -2 3").readLine()
+	original := append([]Token{}, tokens...)
+	stream := NewTokenStream(tokens)
+	stream.Next()
+	mark := stream.Mark()
+
+	// where an operator is expected, the negative number is read as a minus and a positive number
+	if operator, ok := stream.binaryOperator(); !ok || operator.token != TK_MINUS {
+		t.Fatalf("expected a minus operator, got '%s'", operator.String())
+	}
+	if next := stream.Peek(1); next.token != TK_INTEGER || next.Value() != "2" {
+		t.Errorf("expected \"2\" after the minus, got '%s'", next.String())
+	}
+	expected := []string{"-", "2", "3", "end of line"}
+	for i, e := range expected {
+		if token := stream.Next(); token.String() != e {
+			t.Errorf("CaseID %d: wrong token, expected '%s', got '%s'", i, e, token.String())
+		}
+	}
+
+	// the tokens of the line are left alone, after a reset the negative number is read as it was
+	for i := range tokens {
+		if tokens[i].String() != original[i].String() || tokens[i].start != original[i].start {
+			t.Errorf("CaseID %d: token changed from '%s' to '%s'", i, original[i].String(), tokens[i].String())
+		}
+	}
+	stream.Reset(mark)
+	if token := stream.Next(); token.token != TK_INTEGER || token.Value() != "-2" {
+		t.Errorf("expected \"-2\" after the reset, got '%s'", token.String())
+	}
+}
+
+// - Test Parser ----------------------------------------------------------------------------------------------------------------
+
+func TestParseLine(t *testing.T) {
+	testCases := []ParserCase{
+		{"nop\n", "", "nop", TK_UNKNOWN, ""},
+		{"nop", "", "nop", TK_UNKNOWN, ""},
+		{"start: nop\n", "start", "nop", TK_UNKNOWN, ""},
+		{"start:nop // comment\n", "start", "nop", TK_UNKNOWN, ""},
+		{"jmp start\n", "", "jmp", TK_IDENTIFIER, "start"},
+		{"loop-1: push -12\n", "loop-1", "push", TK_INTEGER, "-12"},
+		{"  push 0x1F\n", "", "push", TK_HEXADECIMAL, "1F"},
+		{"\n\n// comment only\npush 1.5\n\n", "", "push", TK_FLOAT, "1.5"},
+		{"table: .byte 1, 2, 3\n", "table", ".byte", TK_INTEGER, "1"},
+		{"pi: .float .5\n", "pi", ".float", TK_FLOAT, ".5"},
+		{"SIZE .equ 4\n", "SIZE", ".equ", TK_INTEGER, "4"},
+		{"count .set count\n", "count", ".set", TK_IDENTIFIER, "count"},
+	}
+
+	for i, c := range testCases {
+		c.verify(t, i)
+	}
+}
+
+func TestParseLineNumbers(t *testing.T) {
+	lexer := newLexer("nop\n\n// comment\nstart: jmp start\n")
+
+	diagnostics := NewDiagnostics()
+	lines := parse(lexer, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	if lines[0].position().line != 1 {
+		t.Errorf("wrong line number, expected 1, got %d", lines[0].position().line)
+	}
+	if lines[1].position().line != 4 {
+		t.Errorf("wrong line number, expected 4, got %d", lines[1].position().line)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := []string{
+		"start:\n",          // missing opcode
+		"start: :\n",        // not an opcode
+		"12\n",              // not an opcode
+		"push 1 2\n",        // two operands
+		"jmp start end\n",   // two operands
+		"push (\n",          // not an operand
+		"push 1 {\n",        // rubbish after the operand
+		"push (1 + 2\n",     // missing bracket
+		"start: nop nop:\n", // rubbish after the operand
+		".byte 1,\n",        // missing operand after the comma
+		".byte 1,,2\n",      // missing operand between the commas
+		".byte ,1\n",        // missing operand before the comma
+	}
+
+	for i, c := range testCases {
+		lexer := newLexer(c)
+		diagnostics := NewDiagnostics()
+		parse(lexer, diagnostics)
+		if diagnostics.err() == nil {
+			t.Errorf("CaseID %d: expected an error for \"%s\"", i, c)
+		}
+	}
+}
+
+func TestLineString(t *testing.T) {
+	lexer := newLexer("start:push 0xff\n")
+
+	diagnostics := NewDiagnostics()
+	lines := parse(lexer, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	expected := "start:          push 0xff"
+	if lines[0].String() != expected {
+		t.Errorf("wrong string, expected \"%s\", got \"%s\"", expected, lines[0].String())
+	}
+}
+
+func TestParseRecovery(t *testing.T) {
+	lexer := newLexer("pushi -x 12\n!nop\nstart:\npushi -\nnop\npushi 1 2\nhalt")
+
+	diagnostics := NewDiagnostics()
+	lines := parse(lexer, diagnostics)
+	if diagnostics.count() != 5 {
+		t.Errorf("wrong number of errors, expected 5, got %d:\n%s", diagnostics.count(), diagnostics.Error())
+	}
+	if len(lines) != 2 {
+		t.Fatalf("wrong number of lines, expected 2, got %d", len(lines))
+	}
+	if lines[0].opcode.Value() != "nop" || lines[0].position().line != 5 {
+		t.Errorf("wrong line, expected \"nop\" on line 5, got \"%s\" on line %d", lines[0].opcode.Value(), lines[0].position().line)
+	}
+	if lines[1].opcode.Value() != "halt" || lines[1].position().line != 7 {
+		t.Errorf("wrong line, expected \"halt\" on line 7, got \"%s\" on line %d", lines[1].opcode.Value(), lines[1].position().line)
+	}
+}
+
+func TestParseOperands(t *testing.T) {
+	lexer := newLexer("table: .int 1, start, 0x10\n")
+
+	diagnostics := NewDiagnostics()
+	lines := parse(lexer, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	expected := []Token{
+		{token: TK_INTEGER, text: []byte("1")},
+		{token: TK_IDENTIFIER, text: []byte("start")},
+		{token: TK_HEXADECIMAL, text: []byte("0x10")},
+	}
+	if len(lines[0].operands) != len(expected) {
+		t.Fatalf("wrong number of operands, expected %d, got %d", len(expected), len(lines[0].operands))
+	}
+	for i, operand := range lines[0].operands {
+		if operand.token.token != expected[i].token || operand.token.Value() != expected[i].Value() {
+			t.Errorf("CaseID %d: wrong operand, expected %s, got %s", i, expected[i].String(), operand.token.String())
+		}
+	}
+	if lines[0].String() != "table:          .int 1, start, 0x10" {
+		t.Errorf("wrong string, got \"%s\"", lines[0].String())
+	}
+}
@@ -0,0 +1,582 @@
+package assembler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// preprocessorDirectives are handled by the preprocessor, they never reach the parser
+var preprocessorDirectives = map[string]bool{
+	".macro":   true,
+	".include": true,
+	".if":      true,
+	".ifdef":   true,
+	".else":    true,
+	".endif":   true,
+}
+
+// - Macro ----------------------------------------------------------------------------------------------------------------------
+
+const MACRO_MAX_DEPTH = 64 // number of macro calls that can be nested within each other
+
+// Macro is a named piece of source code: `.macro <name>(<parameter>{, <parameter>}) { <body> }`. A call to the macro
+// is replaced by its body with the parameters replaced by the arguments of the call.
+type Macro struct {
+	name       Token
+	parameters []Token
+	body       [][]Token // the lines of the body, without the TK_END_OF_LINE
+}
+
+// labels returns the names of the labels defined in the body of the macro, anonymous labels do not have a name
+func (macro Macro) labels() (labels map[string]bool) {
+	labels = make(map[string]bool)
+	for _, tokens := range macro.body {
+		isLabel := len(tokens) >= 2 && isName(tokens[0]) && tokens[1].token == TK_COLON
+		if isLabel && tokens[0].Value() != ANONYMOUS_LABEL {
+			labels[tokens[0].Value()] = true
+		}
+	}
+	return
+}
+
+// expand returns the body with the parameters replaced by the arguments. An argument of more than one token is put
+// between brackets, so `double(1 + 2)` stays 1 + 2 when the body multiplies it. The labels of the body get the unique
+// suffix, so the macro can be used more than once. A label may share its name with an opcode, so the opcode itself is
+// left alone.
+func (macro Macro) expand(arguments [][]Token, suffix string) (lines [][]Token) {
+	replacements := make(map[string][]Token)
+	for i, parameter := range macro.parameters {
+		argument := arguments[i]
+		if len(argument) > 1 {
+			first, last := argument[0], argument[len(argument)-1]
+			open := Token{token: TK_BRACKET_OPEN, start: first.start, end: first.start}
+			closing := Token{token: TK_BRACKET_CLOSE, start: last.end, end: last.end}
+			argument = append(append([]Token{open}, argument...), closing)
+		}
+		replacements[parameter.Value()] = argument
+	}
+	labels := macro.labels()
+
+	for _, body := range macro.body {
+		tokens := []Token{}
+		opcode := 0
+		if len(body) >= 2 && isName(body[0]) && body[1].token == TK_COLON {
+			opcode = 2
+		}
+		for i, token := range body {
+			switch {
+			case !isName(token):
+				tokens = append(tokens, token)
+			case replacements[token.Value()] != nil:
+				tokens = append(tokens, replacements[token.Value()]...)
+			case labels[token.Value()] && i != opcode:
+				token = asName(token)
+				token = token.named(token.Value() + suffix)
+				tokens = append(tokens, token)
+			default:
+				tokens = append(tokens, token)
+			}
+		}
+		lines = append(lines, tokens)
+	}
+	return
+}
+
+// - Include --------------------------------------------------------------------------------------------------------------------
+
+// findInclude looks for the file to include, first in the directory of the file including it, then in the include
+// directories
+func findInclude(name string, from string, directories []string) (path string, err error) {
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = []string{filepath.Join(filepath.Dir(from), name)}
+		for _, directory := range directories {
+			candidates = append(candidates, filepath.Join(directory, name))
+		}
+	}
+	for _, candidate := range candidates {
+		if info, statErr := os.Stat(candidate); statErr == nil && !info.IsDir() {
+			path = candidate
+			return
+		}
+	}
+	err = fmt.Errorf("include file \"%s\" not found", name)
+	return
+}
+
+// sameFile checks if both names point to the same file
+func sameFile(name string, other string) bool {
+	if name == "" || other == "" {
+		return false
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	otherInfo, err := os.Stat(other)
+	return err == nil && os.SameFile(info, otherInfo)
+}
+
+// - Conditional Assembly -------------------------------------------------------------------------------------------------------
+
+// Condition is an open `.if` or `.ifdef`, the lines up to the matching `.else` or `.endif` are only assembled if it holds
+type Condition struct {
+	directive Token // the .if or .ifdef
+	holds     bool  // the lines are assembled
+	skipped   bool  // an enclosing condition does not hold, so neither part is assembled
+	otherwise bool  // the .else has been seen
+}
+
+// active checks if the lines are assembled at this point
+func (p *Preprocessor) active() bool {
+	return len(p.conditions) == 0 || p.conditions[len(p.conditions)-1].holds
+}
+
+// evaluateCondition determines if the condition of `.if <expression>` or `.ifdef <name>` holds
+func (p *Preprocessor) evaluateCondition(tokens []Token) (holds bool, err error) {
+	parser := NewTokenStream(tokens[1:])
+	if parser.AtEnd() {
+		err = NewSourceError(tokens[0].end, "%s needs a condition", tokens[0].Value())
+		return
+	}
+
+	if isDirective(tokens, ".ifdef") {
+		name := parser.Next()
+		if name.token != TK_IDENTIFIER {
+			err = NewSourceError(name.start, "expected name, got '%s'", name.String())
+			return
+		}
+		_, holds = p.symbols[name.Value()]
+	} else {
+		var condition *Expression
+		condition, err = parser.parseExpression()
+		if err != nil {
+			return
+		}
+		var value Value
+		value, err = condition.evaluate(p.symbols)
+		holds = value.asFloat() != 0
+	}
+	if err == nil && !parser.AtEnd() {
+		err = NewSourceError(parser.Peek(0).start, "unexpected '%s' after condition", parser.Peek(0).String())
+	}
+	return
+}
+
+// conditional handles `.if`, `.ifdef`, `.else` and `.endif`. A condition with an error does not hold, so the lines
+// that depend on it do not cause more errors.
+func (p *Preprocessor) conditional(tokens []Token) (err error) {
+	directive := tokens[0]
+	name := strings.ToLower(directive.Value())
+	if name != ".if" && name != ".ifdef" && len(tokens) > 1 {
+		defer func() {
+			if err == nil {
+				err = NewSourceError(tokens[1].start, "unexpected '%s' after %s", tokens[1].String(), directive.Value())
+			}
+		}()
+	}
+
+	switch name {
+	case ".if", ".ifdef":
+		condition := Condition{directive: directive, skipped: !p.active()}
+		if !condition.skipped {
+			condition.holds, err = p.evaluateCondition(tokens)
+		}
+		p.conditions = append(p.conditions, condition)
+	case ".else":
+		if len(p.conditions) == 0 {
+			err = NewSourceError(directive.start, ".else without .if")
+			return
+		}
+		condition := &p.conditions[len(p.conditions)-1]
+		if condition.otherwise {
+			err = NewSourceError(directive.start, "second .else for the %s at %s", condition.directive.Value(), condition.directive.start.String())
+			return
+		}
+		condition.otherwise = true
+		condition.holds = !condition.holds && !condition.skipped
+	case ".endif":
+		if len(p.conditions) == 0 {
+			err = NewSourceError(directive.start, ".endif without .if")
+			return
+		}
+		p.conditions = p.conditions[:len(p.conditions)-1]
+	}
+	return
+}
+
+// isConditional checks if the line is one of the conditional assembly directives
+func isConditional(tokens []Token) bool {
+	if len(tokens) == 0 || tokens[0].token != TK_DIRECTIVE {
+		return false
+	}
+	switch strings.ToLower(tokens[0].Value()) {
+	case ".if", ".ifdef", ".else", ".endif":
+		return true
+	}
+	return false
+}
+
+// - Preprocessor ---------------------------------------------------------------------------------------------------------------
+
+// MacroLine is a line of source code that is the result of a macro call
+type MacroLine struct {
+	tokens []Token
+	depth  int // the number of macro calls it is nested in
+}
+
+// Preprocessor reads the source code line by line and takes care of everything that has to be done before the parser
+// sees the tokens: files are included, macros are defined and their calls expanded, and lines are skipped by
+// conditional assembly. Errors are added to the diagnostics right away, the line with the error is skipped.
+type Preprocessor struct {
+	diagnostics *Diagnostics
+	options     Options
+	macros      map[string]Macro
+	lexer       *Lexer      // the lexer of the file being read
+	pending     []MacroLine // the lines of macro expansions still to go
+	expansions  int         // the number of macro calls expanded, to make their labels unique
+	includes    []*Lexer    // the files that included the one being read, the innermost last
+	symbols     SymbolTable // the symbols defined so far, for conditional assembly
+	conditions  []Condition // the open conditions, the innermost last
+	done        bool        // the end of the source code has been reached
+}
+
+// atEnd checks if all lines have been read
+func (p *Preprocessor) atEnd() bool {
+	return len(p.pending) == 0 && p.lexer.atEnd() && len(p.includes) == 0
+}
+
+// include reads the lines of another file, the current file continues after the included one is done. A file can not
+// include itself, neither directly nor through other files.
+func (p *Preprocessor) include(tokens []Token) (err error) {
+	if len(tokens) < 2 || tokens[1].token != TK_STRING {
+		next := NewTokenStream(tokens[1:]).Peek(0)
+		if len(tokens) < 2 {
+			next.start = tokens[0].end
+		}
+		err = NewSourceError(next.start, "expected file name, got '%s'", next.String())
+		return
+	}
+	if len(tokens) > 2 {
+		err = NewSourceError(tokens[2].start, "unexpected '%s' after file name", tokens[2].String())
+		return
+	}
+
+	path, err := findInclude(tokens[1].Value(), p.lexer.fileName(), p.options.IncludeDirectories)
+	if err != nil {
+		err = NewSourceError(tokens[1].start, "%s", err.Error())
+		return
+	}
+	open := append(p.includes, p.lexer)
+	for i, file := range open {
+		if sameFile(file.fileName(), path) {
+			chain := []string{}
+			for _, file := range open[i:] {
+				chain = append(chain, file.fileName())
+			}
+			chain = append(chain, path)
+			err = NewSourceError(tokens[1].start, "include cycle: %s", strings.Join(chain, " -> "))
+			return
+		}
+	}
+
+	included := NewSourceCode()
+	err = included.LoadFile(path)
+	if err != nil {
+		err = NewSourceError(tokens[1].start, "%s", err.Error())
+		return
+	}
+	p.includes = append(p.includes, p.lexer)
+	p.lexer = NewLexer(included)
+	return
+}
+
+// close closes the file that has been read completely, reporting it if reading it failed
+func (p *Preprocessor) close() {
+	source := p.lexer.source
+	if err := source.Err(); err != nil {
+		p.diagnostics.add(NewSourceError(source.NextPosition(), "%s", err.Error()))
+	}
+	if err := source.Close(); err != nil {
+		p.diagnostics.add(NewSourceError(source.NextPosition(), "%s", err.Error()))
+	}
+}
+
+// readLine reads the tokens of the next line of the source code, on an error the rest of the line is skipped
+func (p *Preprocessor) readLine() (tokens []Token) {
+	tokens, err := p.lexer.readLine()
+	if err != nil {
+		p.diagnostics.add(err)
+		p.lexer.skipLine()
+		tokens = nil
+	}
+	return
+}
+
+// parseParameters reads the parameters of a macro definition: `(<parameter>{, <parameter>})`
+func parseParameters(p *TokenStream) (parameters []Token, err error) {
+	parameters = []Token{}
+	if p.Peek(0).token != TK_BRACKET_OPEN {
+		return
+	}
+	p.Next()
+	for p.Peek(0).token != TK_BRACKET_CLOSE {
+		if len(parameters) > 0 {
+			if p.Peek(0).token != TK_COMMA {
+				err = NewSourceError(p.Peek(0).start, "expected ',' or ')', got '%s'", p.Peek(0).String())
+				return
+			}
+			p.Next()
+		}
+		parameter := p.Next()
+		if parameter.token != TK_IDENTIFIER {
+			err = NewSourceError(parameter.start, "expected parameter name, got '%s'", parameter.String())
+			return
+		}
+		parameters = append(parameters, parameter)
+	}
+	p.Next()
+	return
+}
+
+// define reads a macro definition, the body continues on the next lines up to the closing brace. If the header of the
+// macro is wrong, the body is still skipped so it does not end up as regular source code.
+func (p *Preprocessor) define(tokens []Token) {
+	macro := Macro{}
+	parser := NewTokenStream(tokens)
+	directive := parser.Next()
+
+	// the header: `.macro <name>(<parameter>{, <parameter>}) {`
+	var err error
+	macro.name = parser.Next()
+	switch {
+	case isName(macro.name) && isKeyword(macro.name.Value()):
+		err = NewSourceError(macro.name.start, "\"%s\" can not be used as macro name", macro.name.Value())
+	case macro.name.token != TK_IDENTIFIER:
+		err = NewSourceError(macro.name.start, "expected macro name, got '%s'", macro.name.String())
+	default:
+		macro.parameters, err = parseParameters(parser)
+	}
+	if err == nil && parser.Peek(0).token != TK_BRACE_OPEN {
+		err = NewSourceError(parser.Peek(0).start, "expected '{', got '%s'", parser.Peek(0).String())
+	}
+	for parser.Peek(0).token != TK_BRACE_OPEN && !parser.AtEnd() {
+		parser.Next()
+	}
+	if parser.AtEnd() {
+		p.diagnostics.add(err)
+		return
+	}
+	parser.Next()
+
+	// the body: the rest of the line after the opening brace and the lines up to the matching closing brace
+	line, depth := parser.tokens[parser.next:], 0
+	for {
+		closed := false
+		for i, token := range line {
+			if token.token == TK_BRACE_OPEN {
+				depth++
+			}
+			if token.token == TK_BRACE_CLOSE && depth > 0 {
+				depth--
+			} else if token.token == TK_BRACE_CLOSE {
+				if i+1 < len(line) && err == nil {
+					err = NewSourceError(line[i+1].start, "unexpected '%s' after '}'", line[i+1].String())
+				}
+				line, closed = line[:i], true
+				break
+			}
+		}
+		if len(line) > 0 {
+			macro.body = append(macro.body, append([]Token{}, line...))
+		}
+		if closed {
+			break
+		}
+		if p.lexer.atEnd() {
+			if err == nil {
+				err = NewSourceError(directive.start, "macro \"%s\" is missing its '}'", macro.name.Value())
+			}
+			break
+		}
+		line = p.readLine()
+	}
+
+	if err == nil {
+		if previous, found := p.macros[macro.name.Value()]; found {
+			err = NewSourceError(macro.name.start, "duplicate macro \"%s\", already defined at %s", macro.name.Value(), previous.name.start.String())
+		}
+	}
+	if err != nil {
+		p.diagnostics.add(err)
+		return
+	}
+	p.macros[macro.name.Value()] = macro
+}
+
+// parseArguments reads the arguments of a macro call: `(<argument>{, <argument>})`, where every argument is a list of
+// tokens. Commas between brackets do not separate arguments.
+func parseArguments(p *TokenStream) (arguments [][]Token, err error) {
+	arguments = [][]Token{}
+	if p.Peek(0).token != TK_BRACKET_OPEN {
+		return
+	}
+	open := p.Next()
+	argument, depth := []Token{}, 0
+	for {
+		token := p.Next()
+		switch {
+		case token.token == TK_END_OF_LINE:
+			err = NewSourceError(open.start, "missing ')' after the arguments")
+			return
+		case (token.token == TK_COMMA || token.token == TK_BRACKET_CLOSE) && depth == 0:
+			if len(argument) == 0 && (token.token == TK_COMMA || len(arguments) > 0) {
+				err = NewSourceError(token.start, "missing argument before '%s'", token.String())
+				return
+			}
+			if len(argument) > 0 {
+				arguments = append(arguments, argument)
+			}
+			if token.token == TK_BRACKET_CLOSE {
+				return
+			}
+			argument = []Token{}
+		default:
+			if token.token == TK_BRACKET_OPEN {
+				depth++
+			} else if token.token == TK_BRACKET_CLOSE {
+				depth--
+			}
+			argument = append(argument, token)
+		}
+	}
+}
+
+// expand replaces the macro call by the lines of the macro body. A label in front of the call goes to the first line
+// of the body.
+func (p *Preprocessor) expand(tokens []Token, depth int) (err error) {
+	parser := NewTokenStream(tokens)
+	label := []Token{}
+	if parser.Peek(1).token == TK_COLON {
+		label = []Token{parser.Next(), parser.Next()}
+	}
+	name := parser.Next()
+	macro := p.macros[name.Value()]
+
+	arguments, err := parseArguments(parser)
+	if err != nil {
+		return
+	}
+	if !parser.AtEnd() {
+		err = NewSourceError(parser.Peek(0).start, "unexpected '%s' after macro call", parser.Peek(0).String())
+		return
+	}
+	if len(arguments) != len(macro.parameters) {
+		err = NewSourceError(name.start, "macro \"%s\" takes %d argument(s), got %d", name.Value(), len(macro.parameters), len(arguments))
+		return
+	}
+
+	p.expansions++
+	lines := macro.expand(arguments, "#"+strconv.Itoa(p.expansions))
+	if len(label) > 0 {
+		if len(lines) == 0 {
+			err = NewSourceError(label[0].start, "label \"%s\" on macro \"%s\" without lines", label[0].Value(), name.Value())
+			return
+		}
+		if len(lines[0]) >= 2 && lines[0][1].token == TK_COLON {
+			err = NewSourceError(label[0].start, "label \"%s\" on macro \"%s\" that starts with a label", label[0].Value(), name.Value())
+			return
+		}
+		lines[0] = append(label, lines[0]...)
+	}
+
+	expanded := make([]MacroLine, len(lines))
+	for i, line := range lines {
+		expanded[i] = MacroLine{tokens: line, depth: depth + 1}
+	}
+	p.pending = append(expanded, p.pending...)
+	return
+}
+
+// macroCall checks if the line calls a macro: `[<label>:] <name>[(<argument>{, <argument>})]`
+func (p *Preprocessor) macroCall(tokens []Token) (name Token, ok bool) {
+	if len(tokens) >= 2 && isName(tokens[0]) && tokens[1].token == TK_COLON {
+		tokens = tokens[2:]
+	}
+	if len(tokens) == 0 || tokens[0].token != TK_IDENTIFIER {
+		return
+	}
+	name = tokens[0]
+	_, ok = p.macros[name.Value()]
+	return
+}
+
+// nextLine returns the tokens of the next line for the parser, either from the source code or from a macro expansion.
+// Macro definitions and calls are handled here, so they never reach the parser. At the end of the source code ok is
+// false.
+func (p *Preprocessor) nextLine() (tokens []Token, ok bool) {
+	for !p.atEnd() {
+		depth := 0
+		if len(p.pending) > 0 {
+			tokens, depth = p.pending[0].tokens, p.pending[0].depth
+			p.pending = p.pending[1:]
+		} else if p.lexer.atEnd() {
+			// the end of an included file, continue with the file that included it
+			p.close()
+			p.lexer = p.includes[len(p.includes)-1]
+			p.includes = p.includes[:len(p.includes)-1]
+			continue
+		} else {
+			tokens = p.readLine()
+		}
+
+		name, isCall := p.macroCall(tokens)
+		switch {
+		case isConditional(tokens):
+			if err := p.conditional(tokens); err != nil {
+				p.diagnostics.add(err)
+			}
+		case !p.active():
+			// skipped by conditional assembly
+		case isDirective(tokens, ".macro") && depth > 0:
+			p.diagnostics.add(NewSourceError(tokens[0].start, "a macro can not be defined inside a macro"))
+		case isDirective(tokens, ".macro"):
+			p.define(tokens)
+		case isDirective(tokens, ".include") && depth > 0:
+			p.diagnostics.add(NewSourceError(tokens[0].start, "a file can not be included inside a macro"))
+		case isDirective(tokens, ".include"):
+			if err := p.include(tokens); err != nil {
+				p.diagnostics.add(err)
+			}
+		case isCall && depth >= MACRO_MAX_DEPTH:
+			// a runaway recursion is stopped completely, or it could go on for ages
+			p.diagnostics.add(NewSourceError(name.start, "macro \"%s\" nested more than %d levels deep, is it calling itself?", name.Value(), MACRO_MAX_DEPTH))
+			p.pending = nil
+		case isCall:
+			if err := p.expand(tokens, depth); err != nil {
+				p.diagnostics.add(err)
+			}
+		default:
+			ok = true
+			return
+		}
+	}
+
+	if !p.done {
+		p.done = true
+		p.close()
+		for _, condition := range p.conditions {
+			p.diagnostics.add(NewSourceError(condition.directive.start, "%s without .endif", condition.directive.Value()))
+		}
+	}
+	tokens = nil
+	return
+}
+
+func NewPreprocessor(lexer *Lexer, options Options, symbols SymbolTable, diagnostics *Diagnostics) (p *Preprocessor) {
+	p = &Preprocessor{diagnostics: diagnostics, options: options, macros: make(map[string]Macro), lexer: lexer, symbols: symbols}
+	return
+}
@@ -0,0 +1,213 @@
+package assembler
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// - Test Macros ----------------------------------------------------------------------------------------------------------------
+
+func TestMacro(t *testing.T) {
+	testCases := []EmitterCase{
+		{".macro two(a, b) {\npushi a\npushi b\n}\ntwo(1, 2)\n", []byte{
+			0x10, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x10, 0x02, 0, 0, 0, 0, 0, 0, 0}},
+		{".macro sys(n) { syscall n }\nsys(3)\nsys(4)\n", []byte{0x70, 0x03, 0x70, 0x04}},
+		{".macro double(x) { syscall x * 2 }\ndouble(1 + 2)\n", []byte{0x70, 0x06}},
+		{".macro stop {\n  halt\n}\nstop\nstop()\n", []byte{0x01, 0x01}},
+		{".macro wait() {\nloop: jnz loop\n}\nwait()\nwait()\n", []byte{0x62, 0x00, 0, 0, 0, 0x62, 0x05, 0, 0, 0}},
+		{".macro inner(x) { syscall x }\n.macro outer(y) {\ninner(y)\ninner(y + 1)\n}\nouter(7)\n", []byte{0x70, 0x07, 0x70, 0x08}},
+		{".macro stop { halt }\nnop\nend: stop\njmp end\n", []byte{0x00, 0x01, 0x60, 0x01, 0, 0, 0}},
+		{".macro data(a, b) { .byte a, b }\ndata((1 + 2) * 2, 3)\n", []byte{0x06, 0x03}},
+	}
+
+	for i, c := range testCases {
+		c.verify(t, i)
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	testCases := []struct {
+		sourceCode    string
+		expectedError string
+	}{
+		{".macro loop() {\nloop()\n}\nloop()\n", "2:1: macro \"loop\" nested more than 64 levels deep, is it calling itself?"},
+		{".macro two(a, b) { nop }\ntwo(1)\n", "2:1: macro \"two\" takes 2 argument(s), got 1"},
+		{".macro two(a, b) { nop }\ntwo(1,)\n", "2:7: missing argument before ')'"},
+		{".macro two(a, b) { nop }\ntwo(1, 2\n", "2:4: missing ')' after the arguments"},
+		{".macro two(a, b) { nop }\ntwo(1, 2) 3\n", "2:11: unexpected '3' after macro call"},
+		{".macro open {\nnop\n", "1:1: macro \"open\" is missing its '}'"},
+		{".macro stop { halt }\n.macro stop { nop }\n", "2:8: duplicate macro \"stop\", already defined at 1:8"},
+		{".macro outer {\n.macro inner { nop }\n}\nouter\n", "2:1: a macro can not be defined inside a macro"},
+		{".macro nop { halt }\n", "1:8: \"nop\" can not be used as macro name"},
+		{".macro 12 { halt }\n", "1:8: expected macro name, got '12'"},
+		{".macro two(a b) { halt }\n", "1:14: expected ',' or ')', got 'b'"},
+		{".macro two(a, 1) { halt }\n", "1:15: expected parameter name, got '1'"},
+		{".macro stop halt\n", "1:13: expected '{', got 'halt'"},
+		{".macro stop { halt } nop\n", "1:22: unexpected 'nop' after '}'"},
+		{".macro stop {\nhere: halt\n}\nthere: stop\n", "4:1: label \"there\" on macro \"stop\" that starts with a label"},
+		{".macro empty {\n}\nthere: empty\n", "3:1: label \"there\" on macro \"empty\" without lines"},
+	}
+
+	for i, c := range testCases {
+		lexer := newLexer(c.sourceCode)
+		diagnostics := NewDiagnostics()
+		parse(lexer, diagnostics)
+		if diagnostics.count() != 1 || !strings.Contains(diagnostics.Error(), c.expectedError) {
+			t.Errorf("CaseID %d: expected the error \"%s\", got:\n%s", i, c.expectedError, diagnostics.Error())
+		}
+	}
+}
+
+func TestMacroLines(t *testing.T) {
+	lexer := newLexer(".macro wait(n) {\nloop: jnz loop\n  syscall n\n}\nstart: nop\nwait(1)\nwait(2)\n")
+
+	diagnostics := NewDiagnostics()
+	lines := parse(lexer, diagnostics)
+	if err := diagnostics.err(); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	expected := []string{"start:          nop", "loop#1:         jnz loop#1", "syscall 1", "loop#2:         jnz loop#2", "syscall 2"}
+	if len(lines) != len(expected) {
+		t.Fatalf("wrong number of lines, expected %d, got %d", len(expected), len(lines))
+	}
+	for i, line := range lines {
+		if strings.TrimSpace(line.String()) != expected[i] {
+			t.Errorf("CaseID %d: wrong line, expected \"%s\", got \"%s\"", i, expected[i], line.String())
+		}
+	}
+	if lines[2].position().line != 3 {
+		t.Errorf("wrong line number, expected the line of the macro body 3, got %d", lines[2].position().line)
+	}
+}
+
+// - Test Include ---------------------------------------------------------------------------------------------------------------
+
+// writeFiles creates the files in a temporary directory and returns its name
+func writeFiles(t *testing.T, files map[string]string) (directory string) {
+	directory = t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(directory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("error: %s", err.Error())
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("error: %s", err.Error())
+		}
+	}
+	return
+}
+
+// assembleFile assembles the file with the include directories
+func assembleFile(t *testing.T, fileName string, directories []string) (diagnostics *Diagnostics, code []byte) {
+	source := NewSourceCode()
+	if err := source.LoadFile(fileName); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	defer source.Close()
+	diagnostics = NewDiagnostics()
+	_, _, code = assemble(NewLexer(source), Options{IncludeDirectories: directories}, diagnostics)
+	return
+}
+
+func TestInclude(t *testing.T) {
+	directory := writeFiles(t, map[string]string{
+		"main.asm":       "nop\n.include \"sub/part.asm\"\n.include \"defs.asm\"\nsyscall EXIT\n",
+		"sub/part.asm":   ".include \"inner.asm\"\nhalt",
+		"sub/inner.asm":  "pushi 1\n",
+		"lib/defs.asm":   "EXIT .equ 3\n",
+		"sub/defs.asm":   "EXIT .equ 4\n",
+		"other/defs.asm": "EXIT .equ 5\n",
+	})
+
+	diagnostics, code := assembleFile(t, filepath.Join(directory, "main.asm"), []string{filepath.Join(directory, "lib"), filepath.Join(directory, "other")})
+	if err := diagnostics.err(); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	expected := []byte{0x00, 0x10, 0x01, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x70, 0x03}
+	if !bytes.Equal(code, expected) {
+		t.Errorf("wrong code, expected % x, got % x", expected, code)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	directory := writeFiles(t, map[string]string{
+		"cycle.asm":   "nop\n.include \"loop.asm\"\n",
+		"loop.asm":    ".include \"cycle.asm\"\n",
+		"missing.asm": ".include \"nowhere.asm\"\n",
+		"bad.asm":     "nop\n.include \"broken.asm\"\nhalt\n",
+		"broken.asm":  "nop\n  pushi 0b2\n",
+		"name.asm":    ".include nop\n",
+		"extra.asm":   ".include \"broken.asm\" 1\n",
+		"macro.asm":   ".macro inc { .include \"broken.asm\" }\ninc\n",
+	})
+
+	testCases := []struct {
+		fileName      string
+		expectedError string
+	}{
+		{"cycle.asm", "loop.asm:1:10: include cycle: " + filepath.Join(directory, "cycle.asm") + " -> " + filepath.Join(directory, "loop.asm") + " -> " + filepath.Join(directory, "cycle.asm")},
+		{"missing.asm", "missing.asm:1:10: include file \"nowhere.asm\" not found"},
+		{"bad.asm", "broken.asm:2:9: invalid token (digit '2' in binary number)"},
+		{"name.asm", "name.asm:1:10: expected file name, got 'nop'"},
+		{"extra.asm", "extra.asm:1:23: unexpected '1' after file name"},
+		{"macro.asm", "macro.asm:1:14: a file can not be included inside a macro"},
+	}
+
+	for i, c := range testCases {
+		diagnostics, _ := assembleFile(t, filepath.Join(directory, c.fileName), nil)
+		if diagnostics.count() != 1 || !strings.HasSuffix(diagnostics.Error(), c.expectedError) {
+			t.Errorf("CaseID %d: expected the error \"%s\", got:\n%s", i, c.expectedError, diagnostics.Error())
+		}
+	}
+}
+
+// - Test Conditional Assembly --------------------------------------------------------------------------------------------------
+
+func TestConditional(t *testing.T) {
+	testCases := []EmitterCase{
+		{".if 1\nnop\n.endif\nhalt\n", []byte{0x00, 0x01}},
+		{".if 0\nnop\n.endif\nhalt\n", []byte{0x01}},
+		{".if 0\nnop\n.else\nret\n.endif\n", []byte{0x64}},
+		{"N .equ 2\n.if N - 2\nnop\n.else\nret\n.endif\n", []byte{0x64}},
+		{"N .equ 2\n.ifdef N\nnop\n.endif\n.ifdef M\nret\n.endif\n", []byte{0x00}},
+		{"start: nop\n.ifdef start\nhalt\n.endif\n", []byte{0x00, 0x01}},
+		{".if 1\n.if 0\nnop\n.else\nhalt\n.endif\n.else\n.if 1\nret\n.endif\n.endif\n", []byte{0x01}},
+		{".if 0\n.if 1/0\nnop\n.endif\n.else\nhalt\n.endif\n", []byte{0x01}},
+		{".macro stop(n) {\n.if n\nhalt\n.else\nnop\n.endif\n}\nstop(1)\nstop(0)\n", []byte{0x01, 0x00}},
+		{".if 0\n.macro stop { halt }\n.endif\n.macro stop { nop }\nstop\n", []byte{0x00}},
+	}
+
+	for i, c := range testCases {
+		c.verify(t, i)
+	}
+}
+
+func TestConditionalErrors(t *testing.T) {
+	testCases := []struct {
+		sourceCode    string
+		expectedError string
+	}{
+		{".if\nnop\n.endif\n", "1:4: .if needs a condition"},
+		{".if later\nnop\n.endif\nlater: halt\n", "1:5: undefined symbol \"later\""},
+		{".if 1 2\n.endif\n", "1:7: unexpected '2' after condition"},
+		{".ifdef 1\n.endif\n", "1:8: expected name, got '1'"},
+		{".else\n", "1:1: .else without .if"},
+		{".endif\n", "1:1: .endif without .if"},
+		{".if 1\n.else\n.else\n.endif\n", "3:1: second .else for the .if at 1:1"},
+		{".if 1\n.endif 1\n", "2:8: unexpected '1' after .endif"},
+		{"nop\n.ifdef X\nnop\n", "2:1: .ifdef without .endif"},
+		{".ifdef X\nnop\n.else\nhalt\n", "1:1: .ifdef without .endif"},
+	}
+
+	for i, c := range testCases {
+		lexer := newLexer(c.sourceCode)
+		diagnostics := NewDiagnostics()
+		firstPass(lexer, Options{}, diagnostics)
+		if diagnostics.count() != 1 || !strings.Contains(diagnostics.Error(), c.expectedError) {
+			t.Errorf("CaseID %d: expected the error \"%s\", got:\n%s", i, c.expectedError, diagnostics.Error())
+		}
+	}
+}
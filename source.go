@@ -0,0 +1,293 @@
+package assembler
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// - Source Code ----------------------------------------------------------------------------------------------------------------
+
+// Position is a location in the source code
+type Position struct {
+	file   string
+	line   int // starting at 1
+	column int // in runes, starting at 1
+	offset int // in bytes, starting at 0
+}
+
+// String shows the position the way compilers usually do: `file:line:column`
+func (p Position) String() string {
+	if p.file == "" {
+		return fmt.Sprintf("%d:%d", p.line, p.column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.file, p.line, p.column)
+}
+
+func NewPosition(file string) (p Position) {
+	p = Position{file: file, line: 1, column: 1}
+	return
+}
+
+// END_OF_FILE is what NextRune returns at the end of the source code. It is not a valid rune, so it can not be mistaken
+// for a character in the source code.
+const END_OF_FILE = rune(-1)
+
+// SOURCE_BUFFER_SIZE is the size of the chunks the source code is read in, no matter how big the source code is. The
+// tokens refer to their text in the chunk, so a full chunk is left to the tokens still referring to it and freed
+// together with the last of them.
+const SOURCE_BUFFER_SIZE = 64 * 1024
+
+// SOURCE_MAX_EMPTY_READS is the number of reads in a row without any bytes after which the reader is given up on
+const SOURCE_MAX_EMPTY_READS = 100
+
+// SourceCode streams the text being assembled from a reader and keeps track of where the last rune read from it is.
+// Only the last rune is remembered, so it can be read again after PrevRune. Its line and column are only worked out
+// when asked for, as most runes are never asked about. The source code is read into chunks that are never written
+// over, so a token can refer to its text in the source code without copying it.
+type SourceCode struct {
+	reader    io.Reader
+	closer    io.Closer // the file to close when done, nil if there is none
+	err       error     // the error AtEnd ran into, NextRune returns its errors itself
+	readErr   error     // the error of the last read, returned once the bytes read before it are used up
+	file      string    // the name of the file, empty for source code that did not come from a file
+	offset    int       // offset of the rune that was read last, in bytes
+	line      int       // line of the rune that was read last, starting at 1
+	lineStart int       // offset of the first rune of that line
+	wide      int       // the bytes of that line up to the last rune, in excess of one per rune
+	last      rune      // the rune that was read last
+	lastSize  int       // the number of bytes of the rune that was read last, in the source code
+	unread    bool      // the last rune is read again by the next NextRune
+	canUnread bool      // a rune was read since the last PrevRune
+	chunk     []byte    // the source code read so far, up to its capacity
+	next      int       // where the byte that is read next is in the chunk
+	span      int       // where the current span starts in the chunk
+	spanning  bool      // a span has been started and not ended yet
+}
+
+// Load streams the source code from the reader, the name is used for the positions
+func (sc *SourceCode) Load(r io.Reader, name string) (err error) {
+	sc.reader = r
+	sc.closer = nil
+	sc.file, sc.offset, sc.line, sc.lineStart, sc.wide = name, 0, 1, 0, 0
+	sc.last, sc.lastSize = 0, 0
+	sc.unread, sc.canUnread = false, false
+	sc.err, sc.readErr = nil, nil
+	sc.chunk, sc.next, sc.span, sc.spanning = nil, 0, 0, false
+	return
+}
+
+// LoadFile opens a file to stream the source code from, it stays open until Close is called
+func (sc *SourceCode) LoadFile(fileName string) (err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return
+	}
+
+	err = sc.Load(file, fileName)
+	sc.closer = file
+	return
+}
+
+// LoadString loads a string into the buffer
+func (sc *SourceCode) LoadString(s string) (err error) {
+	err = sc.Load(strings.NewReader(s), "")
+	return
+}
+
+// Close closes the file the source code was read from, if any
+func (sc *SourceCode) Close() (err error) {
+	if sc.closer != nil {
+		err = sc.closer.Close()
+		sc.closer = nil
+	}
+	return
+}
+
+// NextRune reads the nextchar from the reader
+// at the end it returns END_OF_FILE instead of an io.EOF error to allow
+// for far easier processing in a read-ahead parser. A Windows "\r\n" and an old Mac "\r" are read as a single '\n', so
+// the rest of the assembler only has to deal with one kind of line ending.
+func (sc *SourceCode) NextRune() (c rune, err error) {
+	sc.canUnread = true
+	if sc.unread {
+		c, sc.unread = sc.last, false
+		return
+	}
+
+	sc.passLast()
+	c, size, err := sc.readRune()
+	if err == io.EOF {
+		c, err = END_OF_FILE, nil
+	}
+	if err != nil {
+		return
+	}
+	sc.last, sc.lastSize = c, size
+	if c == rune('\r') {
+		sc.last = rune('\n')
+		if sc.fill(1) && sc.chunk[sc.next] == '\n' {
+			sc.next++
+			sc.lastSize++
+		}
+	}
+	c = sc.last
+	return
+}
+
+// NextRun reads past the characters that are part of the run, straight from the chunk, and returns the rune after
+// them like NextRune does. The rune read last has to be part of the run as well.
+func (sc *SourceCode) NextRun(run *[utf8.RuneSelf]bool) (c rune, err error) {
+	if !sc.unread {
+		sc.passLast()
+		chunk, next := sc.chunk, sc.next
+		for next < len(chunk) && chunk[next] < utf8.RuneSelf && run[chunk[next]] {
+			next++
+		}
+		sc.next, sc.lastSize = next, next-sc.next
+	}
+	return sc.NextRune()
+}
+
+// passLast moves past the rune that was read last, so the position is that of the rune that is read next
+func (sc *SourceCode) passLast() {
+	sc.offset += sc.lastSize
+	switch {
+	case sc.last == rune('\n'):
+		sc.line++
+		sc.lineStart, sc.wide = sc.offset, 0
+	case sc.last >= utf8.RuneSelf:
+		sc.wide += sc.lastSize - 1
+	}
+	sc.last, sc.lastSize = 0, 0
+}
+
+// readRune reads a rune from the chunk, an invalid byte is read as utf8.RuneError of a single byte
+func (sc *SourceCode) readRune() (c rune, size int, err error) {
+	if sc.next == len(sc.chunk) && !sc.fill(1) {
+		err, sc.readErr = sc.readErr, nil
+		return
+	}
+	if b := sc.chunk[sc.next]; b < utf8.RuneSelf {
+		c, size = rune(b), 1
+	} else {
+		if len(sc.chunk)-sc.next < utf8.UTFMax {
+			sc.fill(utf8.UTFMax)
+		}
+		c, size = utf8.DecodeRune(sc.chunk[sc.next:])
+	}
+	sc.next += size
+	return
+}
+
+// fill reads from the reader until the chunk has at least the given number of bytes left to read, it reports if it
+// succeeded. Once the reader fails, the rest of the chunk is read first before its error is returned.
+func (sc *SourceCode) fill(size int) bool {
+	for empty := 0; len(sc.chunk)-sc.next < size && sc.readErr == nil; {
+		if len(sc.chunk) == cap(sc.chunk) {
+			sc.newChunk()
+		}
+		n, err := sc.reader.Read(sc.chunk[len(sc.chunk):cap(sc.chunk)])
+		sc.chunk, sc.readErr = sc.chunk[:len(sc.chunk)+n], err
+		switch {
+		case n > 0:
+			empty = 0
+		case err == nil:
+			empty++
+			if empty == SOURCE_MAX_EMPTY_READS {
+				sc.readErr = io.ErrNoProgress
+			}
+		}
+	}
+	return len(sc.chunk)-sc.next >= size
+}
+
+// newChunk continues in a new chunk. The bytes still needed are copied to it: the last rune, it may start a span, and
+// the current span. A span longer than a chunk gets a chunk big enough for it.
+func (sc *SourceCode) newChunk() {
+	keep := sc.next - sc.lastSize
+	if sc.spanning && sc.span < keep {
+		keep = sc.span
+	}
+	size := SOURCE_BUFFER_SIZE
+	for size < 2*(len(sc.chunk)-keep) {
+		size *= 2
+	}
+	chunk := make([]byte, len(sc.chunk)-keep, size)
+	copy(chunk, sc.chunk[keep:])
+	sc.chunk, sc.next, sc.span = chunk, sc.next-keep, sc.span-keep
+}
+
+// startSpan starts a span at the rune that was read last
+func (sc *SourceCode) startSpan() {
+	sc.span, sc.spanning = sc.next-sc.lastSize, true
+}
+
+// endSpan ends the current span after the given number of bytes and returns them, they stay as they are for as long as
+// the span is referred to
+func (sc *SourceCode) endSpan(size int) (span []byte) {
+	end := sc.span + size
+	span = sc.chunk[sc.span:end:end]
+	sc.spanning = false
+	return
+}
+
+// PrevRune unreads the last rune so it can be re-processed, only a single rune can be unread
+func (sc *SourceCode) PrevRune() (err error) {
+	if !sc.canUnread {
+		err = fmt.Errorf("can not unread more than one rune")
+		return
+	}
+	sc.unread, sc.canUnread = true, false
+	return
+}
+
+// Position returns the position of the rune that was read last
+func (sc *SourceCode) Position() (p Position) {
+	sc.positionOf(&p)
+	return
+}
+
+// positionOf fills in the position of the rune that was read last, the lexer fills in its tokens this way as copying a
+// whole position into them turned out to stall the processor
+func (sc *SourceCode) positionOf(p *Position) {
+	p.file, p.line, p.column, p.offset = sc.file, sc.line, sc.offset-sc.lineStart-sc.wide+1, sc.offset
+}
+
+// NextPosition returns the position of the rune that will be read next
+func (sc *SourceCode) NextPosition() Position {
+	if sc.unread {
+		return sc.Position()
+	}
+	next := *sc
+	next.passLast()
+	return next.Position()
+}
+
+// AtEnd reports if all of the source code has been read
+func (sc *SourceCode) AtEnd() bool {
+	if sc.unread {
+		return sc.last == END_OF_FILE
+	}
+	if sc.fill(1) {
+		return false
+	}
+	if sc.readErr != io.EOF && sc.err == nil {
+		sc.err = sc.readErr
+	}
+	sc.readErr = nil
+	return true
+}
+
+// Err returns the error that made AtEnd stop the reading of the source code, nil if it was read up to the end
+func (sc *SourceCode) Err() error {
+	return sc.err
+}
+
+func NewSourceCode() (sc *SourceCode) {
+	sc = new(SourceCode)
+	sc.LoadString("")
+	return
+}
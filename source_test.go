@@ -0,0 +1,211 @@
+package assembler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+)
+
+// - Test Source Code -----------------------------------------------------------------------------------------------------------
+
+func TestNextRune(t *testing.T) {
+	source := NewSourceCode()
+	source.Load(iotest.OneByteReader(strings.NewReader("aé\r\nb\rc")), "prog.asm")
+
+	expected := []struct {
+		char     rune
+		position Position
+	}{
+		{'a', Position{"prog.asm", 1, 1, 0}},
+		{'é', Position{"prog.asm", 1, 2, 1}},
+		{'\n', Position{"prog.asm", 1, 3, 3}},
+		{'b', Position{"prog.asm", 2, 1, 5}},
+		{'\n', Position{"prog.asm", 2, 2, 6}},
+		{'c', Position{"prog.asm", 3, 1, 7}},
+		{END_OF_FILE, Position{"prog.asm", 3, 2, 8}},
+		{END_OF_FILE, Position{"prog.asm", 3, 2, 8}},
+	}
+
+	for i, e := range expected {
+		char, err := source.NextRune()
+		if err != nil {
+			t.Fatalf("CaseID %d: %s", i, err.Error())
+		}
+		if char != e.char {
+			t.Errorf("CaseID %d: wrong char, expected %q, got %q", i, e.char, char)
+		}
+		if source.Position() != e.position {
+			t.Errorf("CaseID %d: wrong position, expected %v, got %v", i, e.position, source.Position())
+		}
+	}
+	if !source.AtEnd() {
+		t.Errorf("expected the end of the source code")
+	}
+}
+
+func TestPrevRune(t *testing.T) {
+	source := NewSourceCode()
+	source.LoadString("a\r\nb")
+
+	if err := source.PrevRune(); err == nil {
+		t.Errorf("expected an error unreading before reading")
+	}
+	source.NextRune()
+	char, _ := source.NextRune()
+	if err := source.PrevRune(); err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	if err := source.PrevRune(); err == nil {
+		t.Errorf("expected an error unreading a second rune")
+	}
+	again, _ := source.NextRune()
+	if again != char || source.Position() != (Position{"", 1, 2, 1}) {
+		t.Errorf("expected to read '\\n' at 1:2 again, got %q at %v", again, source.Position())
+	}
+	if char, _ = source.NextRune(); char != 'b' || source.Position() != (Position{"", 2, 1, 3}) {
+		t.Errorf("expected to read 'b' at 2:1, got %q at %v", char, source.Position())
+	}
+
+	source.NextRune()
+	source.PrevRune()
+	if !source.AtEnd() {
+		t.Errorf("expected the end of the source code after unreading it")
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	source := NewSourceCode()
+	source.Load(iotest.HalfReader(strings.NewReader("label_1  é_x\r\n  y")), "prog.asm")
+
+	identifier, space := &runs[ST_IDENTIFIER], &runs[ST_WHITE_SPACE]
+	expected := []struct {
+		run      *[utf8.RuneSelf]bool // nil to read a single rune
+		char     rune
+		position Position
+	}{
+		{nil, 'l', Position{"prog.asm", 1, 1, 0}},
+		{identifier, ' ', Position{"prog.asm", 1, 8, 7}},
+		{space, 'é', Position{"prog.asm", 1, 10, 9}},
+		{nil, '_', Position{"prog.asm", 1, 11, 11}},
+		{identifier, '\n', Position{"prog.asm", 1, 13, 13}},
+		{nil, ' ', Position{"prog.asm", 2, 1, 15}},
+		{space, 'y', Position{"prog.asm", 2, 3, 17}},
+		{nil, END_OF_FILE, Position{"prog.asm", 2, 4, 18}},
+	}
+
+	for i, e := range expected {
+		var char rune
+		var err error
+		if e.run == nil {
+			char, err = source.NextRune()
+		} else {
+			char, err = source.NextRun(e.run)
+		}
+		if err != nil {
+			t.Fatalf("CaseID %d: %s", i, err.Error())
+		}
+		if char != e.char || source.Position() != e.position {
+			t.Errorf("CaseID %d: expected %q at %v, got %q at %v", i, e.char, e.position, char, source.Position())
+		}
+	}
+}
+
+func TestSpan(t *testing.T) {
+	source := NewSourceCode()
+	source.Load(iotest.OneByteReader(strings.NewReader("ab  \xffé\r\n")), "")
+
+	source.NextRune()
+	source.startSpan()
+	source.NextRune()
+	source.NextRune()
+	first := source.endSpan(2)
+	source.NextRune()
+	source.NextRune()
+	source.startSpan()
+	source.NextRune()
+	source.NextRune()
+	second := source.endSpan(3)
+	source.startSpan()
+	source.NextRune()
+	third := source.endSpan(2)
+
+	// the invalid byte is kept as it is, the spans do not overwrite each other
+	for i, e := range []struct{ span, expected []byte }{{first, []byte("ab")}, {second, []byte("\xffé")}, {third, []byte("\r\n")}} {
+		if !bytes.Equal(e.span, e.expected) {
+			t.Errorf("CaseID %d: wrong span, expected %q, got %q", i, e.expected, e.span)
+		}
+	}
+}
+
+// lineReader generates the lines of a source code on the fly, so a big source code does not have to be in memory
+type lineReader struct {
+	line    string
+	count   int // the number of lines still to go
+	pending []byte
+}
+
+func (r *lineReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if len(r.pending) == 0 {
+			if r.count == 0 {
+				break
+			}
+			r.pending = []byte(r.line)
+			r.count--
+		}
+		copied := copy(p[n:], r.pending)
+		r.pending = r.pending[copied:]
+		n += copied
+	}
+	if n == 0 {
+		err = io.EOF
+	}
+	return
+}
+
+func TestAssembleStream(t *testing.T) {
+	lines := 20000
+	program, err := Assemble(&lineReader{line: "        .byte 1, 2, 3 // a table\r\n", count: lines}, Options{})
+	if err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	if len(program.Code) != 3*lines || !bytes.Equal(program.Code[len(program.Code)-3:], []byte{1, 2, 3}) {
+		t.Errorf("wrong code, expected %d bytes ending in 01 02 03, got %d bytes", 3*lines, len(program.Code))
+	}
+
+	_, err = Assemble(iotest.TimeoutReader(strings.NewReader("nop\n")), Options{})
+	if err == nil || err.Error() != "1:4: timeout" {
+		t.Errorf("expected the error \"1:4: timeout\", got %v", err)
+	}
+}
+
+func TestAssembleMemory(t *testing.T) {
+	// about 10 MB of source code, only the first line has to wait for the second pass
+	line, lines := "        .byte 1, 2, 3 // a table\r\n", 300000
+	source := io.MultiReader(strings.NewReader("        .int end\n"), &lineReader{line: line, count: lines}, strings.NewReader("end:    .byte 4\n"))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	program, err := Assemble(source, Options{SkipListing: true})
+	if err != nil {
+		t.Fatalf("error: %s", err.Error())
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	size := 8 + 3*lines + 1
+	if len(program.Code) != size || binary.LittleEndian.Uint64(program.Code) != uint64(size-1) {
+		t.Errorf("wrong code, expected %d bytes starting with the address of end, got %d bytes", size, len(program.Code))
+	}
+	limit := uint64(size) + 4<<20
+	if after.HeapAlloc > before.HeapAlloc && after.HeapAlloc-before.HeapAlloc > limit {
+		t.Errorf("expected at most %d bytes in use, got %d for %d bytes of source code", limit, after.HeapAlloc-before.HeapAlloc, len(line)*lines)
+	}
+	runtime.KeepAlive(program)
+}
@@ -0,0 +1,216 @@
+package assembler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// - Symbol ---------------------------------------------------------------------------------------------------------------------
+
+const (
+	SY_LABEL = iota // the address of a line
+	SY_EQU          // a constant defined by `.equ`, it can not be changed
+	SY_SET          // a constant defined by `.set`, it can be redefined further down
+)
+
+// Symbol is a name with a value, for a label this is the address it points to
+type Symbol struct {
+	name  string
+	kind  int // SY_...
+	value Value
+	where Position // where the symbol is defined
+}
+
+// - Symbol Table ---------------------------------------------------------------------------------------------------------------
+
+// SymbolTable keeps track of all symbols by their name
+type SymbolTable map[string]Symbol
+
+// define adds a new label to the table, a label can only be defined once
+func (symbols SymbolTable) define(name string, value int64, where Position) (err error) {
+	if previous, found := symbols[name]; found {
+		err = fmt.Errorf("duplicate label \"%s\", already defined at %s", name, previous.where.String())
+		return
+	}
+	symbols[name] = Symbol{name: name, kind: SY_LABEL, value: NewIntegerValue(value), where: where}
+	return
+}
+
+// assign gives a constant its value, only a constant defined by `.set` can be assigned again by another `.set`
+func (symbols SymbolTable) assign(name string, value Value, kind int, where Position) (err error) {
+	if previous, found := symbols[name]; found && (previous.kind != SY_SET || kind != SY_SET) {
+		err = fmt.Errorf("duplicate symbol \"%s\", already defined at %s", name, previous.where.String())
+		return
+	}
+	symbols[name] = Symbol{name: name, kind: kind, value: value, where: where}
+	return
+}
+
+// resolve looks up the value of a symbol
+func (symbols SymbolTable) resolve(name string) (value Value, err error) {
+	symbol, found := symbols[name]
+	if !found && strings.Index(name, ".") > 0 {
+		err = symbols.undefinedLocal(name)
+		return
+	}
+	if !found {
+		err = fmt.Errorf("undefined symbol \"%s\"", name)
+		return
+	}
+	value = symbol.value
+	return
+}
+
+// undefinedLocal explains that a local label is not defined under its global label, pointing out where it is defined
+func (symbols SymbolTable) undefinedLocal(name string) (err error) {
+	split := strings.Index(name, ".")
+	global, local := name[:split], name[split:]
+	others := []string{}
+	for other := range symbols {
+		if i := strings.Index(other, "."); i > 0 && other[i:] == local {
+			others = append(others, other[:i])
+		}
+	}
+	if len(others) == 0 {
+		err = fmt.Errorf("undefined local label \"%s\" under \"%s\"", local, global)
+		return
+	}
+	sort.Strings(others)
+	err = fmt.Errorf("undefined local label \"%s\" under \"%s\", it is only defined under \"%s\"", local, global, strings.Join(others, "\", \""))
+	return
+}
+
+func NewSymbolTable() (symbols SymbolTable) {
+	symbols = make(SymbolTable)
+	return
+}
+
+// - Scope ----------------------------------------------------------------------------------------------------------------------
+
+const ANONYMOUS_LABEL = "@@" // the name of every anonymous label, the references are `@f` and `@b`
+
+// isLocal checks if the name is a local label, one that belongs to the global label before it
+func isLocal(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// Scope keeps track of the labels local and anonymous labels refer to, while going through the lines in order. A
+// local label `.loop` belongs to the last global label before it and is known as `start.loop`, the anonymous labels
+// are numbered `@@1`, `@@2`, ...
+type Scope struct {
+	global    Token   // the last global label
+	anonymous int     // the number of anonymous labels so far
+	forward   []Token // the references to the next anonymous label, while it has not come yet
+}
+
+// define returns the full name of a label and makes it the scope for the local labels that follow. Labels generated by
+// a macro do not start a new scope, so the local labels around a macro call stay together.
+func (scope *Scope) define(label Token) (name string, err error) {
+	value := label.Value()
+	switch {
+	case value == ANONYMOUS_LABEL:
+		scope.anonymous++
+		scope.forward = nil
+		name = ANONYMOUS_LABEL + strconv.Itoa(scope.anonymous)
+	case isLocal(value):
+		name, err = scope.resolve(label)
+	default:
+		name = value
+		if !strings.Contains(value, "#") {
+			scope.global = label
+		}
+	}
+	return
+}
+
+// resolve returns the full name of a label that is referred to
+func (scope *Scope) resolve(reference Token) (name string, err error) {
+	value := reference.Value()
+	switch {
+	case value == ANONYMOUS_LABEL:
+		err = fmt.Errorf("ambiguous reference to an anonymous label, use @f for the next one or @b for the previous one")
+	case value == "@b" && scope.anonymous == 0:
+		err = fmt.Errorf("no anonymous label before @b")
+	case value == "@b":
+		name = ANONYMOUS_LABEL + strconv.Itoa(scope.anonymous)
+	case value == "@f":
+		name = ANONYMOUS_LABEL + strconv.Itoa(scope.anonymous+1)
+		scope.forward = append(scope.forward, reference)
+	case isLocal(value) && scope.global.token == TK_UNKNOWN:
+		err = fmt.Errorf("local label \"%s\" has no global label before it", value)
+	case isLocal(value):
+		name = scope.global.Value() + value
+	default:
+		name = value
+	}
+	return
+}
+
+// check reports the references to the next anonymous label when there is none
+func (scope *Scope) check() (errs []error) {
+	for _, reference := range scope.forward {
+		errs = append(errs, NewSourceError(reference.start, "no anonymous label after @f"))
+	}
+	return
+}
+
+func NewScope() (scope *Scope) {
+	scope = new(Scope)
+	return
+}
+
+// - Label Rules ----------------------------------------------------------------------------------------------------------------
+
+// LabelRules describe what a valid label looks like: it starts with a letter or underscore, followed by letters,
+// digits, underscores or dashes
+type LabelRules struct {
+	unicode   bool // letters outside of a-z and A-Z are allowed
+	maxLength int  // the maximum number of characters, 0 for no limit
+}
+
+// STRICT_LABELS follow the rules in the README, RELAXED_LABELS accept any letter and any length
+var (
+	STRICT_LABELS  = LabelRules{unicode: false, maxLength: 64}
+	RELAXED_LABELS = LabelRules{unicode: true, maxLength: 0}
+)
+
+// isLetter checks if the rune is a letter the rules allow
+func (rules LabelRules) isLetter(c rune) bool {
+	if rules.unicode {
+		return unicode.IsLetter(c)
+	}
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isDigit checks if the rune is a digit the rules allow
+func (rules LabelRules) isDigit(c rune) bool {
+	if rules.unicode {
+		return unicode.IsDigit(c)
+	}
+	return c >= '0' && c <= '9'
+}
+
+// validate checks the name of a label or constant, the dot of a local label is not part of the name
+func (rules LabelRules) validate(name string) (err error) {
+	name = strings.TrimPrefix(name, ".")
+	for i, c := range name {
+		switch {
+		case rules.isLetter(c) || c == '_':
+		case i > 0 && (c == '-' || rules.isDigit(c)):
+		case i == 0:
+			err = fmt.Errorf("label \"%s\" must start with a letter or underscore", name)
+			return
+		default:
+			err = fmt.Errorf("label \"%s\" can not contain '%c'", name, c)
+			return
+		}
+	}
+	if length := utf8.RuneCountInString(name); rules.maxLength > 0 && length > rules.maxLength {
+		err = fmt.Errorf("label \"%s\" is %d characters long, the maximum is %d", name, length, rules.maxLength)
+	}
+	return
+}
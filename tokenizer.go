@@ -1,8 +1,12 @@
-package main
+package assembler
 
 import (
+	"bytes"
 	"fmt"
+	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // - Token ----------------------------------------------------------------------------------------------------------------------
@@ -19,331 +23,798 @@ const (
 	TK_BRACE_OPEN
 	TK_BRACE_CLOSE
 	TK_END_OF_LINE
+	TK_COMMA
+	TK_STRING
+	TK_CHAR
+	TK_BINARY
+	TK_OCTAL
+	TK_PLUS
+	TK_MINUS
+	TK_STAR
+	TK_SLASH
+	TK_PERCENT
+	TK_SHIFT_LEFT
+	TK_SHIFT_RIGHT
+	TK_AMPERSAND
+	TK_PIPE
+	TK_CARET
+	TK_TILDE
+	TK_MNEMONIC
+	TK_DIRECTIVE
+	TK_REGISTER
+	TK_END_OF_FILE
 )
 
+// operators are the tokens that consist of nothing but their symbol
+var operators = map[int]string{
+	TK_PLUS:        "+",
+	TK_MINUS:       "-",
+	TK_STAR:        "*",
+	TK_SLASH:       "/",
+	TK_PERCENT:     "%",
+	TK_SHIFT_LEFT:  "<<",
+	TK_SHIFT_RIGHT: ">>",
+	TK_AMPERSAND:   "&",
+	TK_PIPE:        "|",
+	TK_CARET:       "^",
+	TK_TILDE:       "~",
+}
+
 type Token struct {
 	token int
-	value string
+	text  []byte   // the token as it is written, a span of the source code it was read from
+	start Position // position of the first rune of the token
+	end   Position // position of the first rune after the token
+}
+
+// Text returns the token as it is written in the source code
+func (thisToken Token) Text() string {
+	return string(thisToken.text)
 }
 
-func (thisToken Token) append(c rune) (nextToken Token) {
+// Value returns the value of the token, like a name, the digits of a number or a decoded string. It is only made when
+// asked for, so reading a token does not allocate anything. Operators and other symbols have no value.
+func (thisToken Token) Value() string {
+	switch thisToken.token {
+	case TK_IDENTIFIER, TK_MNEMONIC, TK_DIRECTIVE, TK_REGISTER:
+		if len(thisToken.text) > 0 && thisToken.text[0] == '@' {
+			return strings.ToLower(string(thisToken.text))
+		}
+		return string(thisToken.text)
+	case TK_INTEGER, TK_FLOAT:
+		return withoutUnderscores(thisToken.text)
+	case TK_HEXADECIMAL, TK_BINARY, TK_OCTAL:
+		sign, number := prefixedDigits(thisToken.text)
+		return sign + withoutUnderscores(number)
+	case TK_STRING, TK_CHAR:
+		value, _ := unescape(unquoted(thisToken.text))
+		return value
+	}
+	return ""
+}
+
+// characters returns the values of the characters of a string, see decode
+func (thisToken Token) characters() (values []int64) {
+	values, _ = decode(unquoted(thisToken.text))
+	return
+}
+
+// copyText copies the text of the token to the end of the buffer, the token returned refers to the copy
+func (thisToken Token) copyText(buffer []byte) (nextToken Token, nextBuffer []byte) {
 	nextToken = thisToken
-	nextToken.value += string(c)
+	start := len(buffer)
+	nextBuffer = append(buffer, thisToken.text...)
+	nextToken.text = nextBuffer[start:len(nextBuffer):len(nextBuffer)]
 	return
 }
 
-func (thisToken Token) clear() (nextToken Token) {
+// named gives the token another name, like the full name of a local label or the unique name of a label in a macro
+func (thisToken Token) named(name string) (nextToken Token) {
 	nextToken = thisToken
-	nextToken.value = ""
+	nextToken.text = []byte(name)
+	return
+}
+
+// String shows the token the way it would look in the source code
+func (thisToken Token) String() string {
+	switch thisToken.token {
+	case TK_HEXADECIMAL:
+		return withPrefix("0x", thisToken.Value())
+	case TK_BINARY:
+		return withPrefix("0b", thisToken.Value())
+	case TK_OCTAL:
+		return withPrefix("0o", thisToken.Value())
+	case TK_COLON:
+		return ":"
+	case TK_COMMA:
+		return ","
+	case TK_STRING:
+		return strconv.Quote(thisToken.Value())
+	case TK_CHAR:
+		value := thisToken.Value()
+		if value == "'" {
+			return "'\\''"
+		}
+		return "'" + strings.Trim(strconv.Quote(value), "\"") + "'"
+	case TK_BRACKET_OPEN:
+		return "("
+	case TK_BRACKET_CLOSE:
+		return ")"
+	case TK_BRACE_OPEN:
+		return "{"
+	case TK_BRACE_CLOSE:
+		return "}"
+	case TK_END_OF_LINE:
+		return "end of line"
+	case TK_END_OF_FILE:
+		return "end of file"
+	}
+	if symbol, ok := operators[thisToken.token]; ok {
+		return symbol
+	}
+	return thisToken.Value()
+}
+
+// withoutUnderscores returns the digits of a number without the underscores that separate them
+func withoutUnderscores(text []byte) string {
+	if bytes.IndexByte(text, '_') < 0 {
+		return string(text)
+	}
+	return strings.ReplaceAll(string(text), "_", "")
+}
+
+// prefixedDigits splits a number with a prefix like 0x into its sign and its digits, the prefix is dropped
+func prefixedDigits(text []byte) (sign string, number []byte) {
+	if len(text) > 0 && text[0] == '-' {
+		sign, text = "-", text[1:]
+	}
+	if len(text) >= 2 && text[0] == '0' && strings.IndexByte("xXbBoO", text[1]) >= 0 {
+		text = text[2:]
+	}
+	number = text
 	return
 }
 
+// unquoted returns the text of a string or character without its quotes
+func unquoted(text []byte) string {
+	if len(text) < 2 {
+		return ""
+	}
+	return string(text[1 : len(text)-1])
+}
+
+// withPrefix puts the prefix of a number between its sign and its digits
+func withPrefix(prefix string, value string) string {
+	if strings.HasPrefix(value, "-") {
+		return "-" + prefix + value[1:]
+	}
+	return prefix + value
+}
+
 func NewToken() (token Token) {
 	token = Token{}
 	return
 }
 
-// - Tokenizer ------------------------------------------------------------------------------------------------------------------
+// singleSymbols are the tokens that consist of a single character, they are complete as soon as it is read
+var singleSymbols = map[rune]int{
+	':': TK_COLON,
+	',': TK_COMMA,
+	'(': TK_BRACKET_OPEN,
+	')': TK_BRACKET_CLOSE,
+	'{': TK_BRACE_OPEN,
+	'}': TK_BRACE_CLOSE,
+	'+': TK_PLUS,
+	'*': TK_STAR,
+	'%': TK_PERCENT,
+	'&': TK_AMPERSAND,
+	'|': TK_PIPE,
+	'^': TK_CARET,
+	'~': TK_TILDE,
+}
+
+// - Character Classes ----------------------------------------------------------------------------------------------------------
 
 const (
-	ST_WHITE_SPACE    = iota // Reads leading whitespace before the token
-	ST_TOKEN_START           // Interprets the first character of the token
-	ST_COMMENT_START         // Tries to 'prove' a comment
-	ST_COMMENT               // Reads the comment
-	ST_IDENTIFIER            // Reads an identifier
-	ST_NEGATIVE              // Reads a negative number
-	ST_NUMBER_PREFIX         // Sorts out the type of number
-	ST_NUMBER                // Reading decimals digits
-	ST_HEXADECIMAL           // reading hexadecimal digits
-	ST_FRACTION_START        // reading first decimal after dot
-	ST_FRACTION              // reading next decimals after dot
-	ST_END            = 999  // Token read, all is well
+	CC_OTHER       = iota // Anything without a meaning of its own
+	CC_SPACE              // White space, except for the end of a line
+	CC_NEWLINE            // The end of a line
+	CC_END_OF_FILE        // The end of the source code
+	CC_SYMBOL             // A token all by itself, see singleSymbols
+	CC_LETTER             // A letter that is not a hexadecimal digit or a number prefix
+	CC_HEX_LETTER         // a, c, d and their capitals
+	CC_B                  // b or B, a hexadecimal digit and the binary prefix
+	CC_E                  // e or E, a hexadecimal digit and the exponent
+	CC_F                  // f or F, a hexadecimal digit and the forward anonymous label
+	CC_O                  // o or O, the octal prefix
+	CC_X                  // x or X, the hexadecimal prefix
+	CC_UNDERSCORE         // Part of a name, or a separator between digits
+	CC_ZERO               // 0
+	CC_ONE                // 1
+	CC_OCTAL              // 2 up to 7
+	CC_DECIMAL            // 8 and 9
+	CC_DIGIT              // Any other digit
+	CC_DOT                // .
+	CC_MINUS              // -
+	CC_PLUS               // +, a token by itself but also the sign of an exponent
+	CC_AT                 // @
+	CC_QUOTE              // "
+	CC_APOSTROPHE         // '
+	CC_BACKSLASH          // \
+	CC_SLASH              // /
+	CC_LESS               // <
+	CC_GREATER            // >
+	CC_COUNT              // The number of character classes
 )
 
-type State func(thisChar rune, thisToken Token) (state int, nextChar rune, nextToken Token, err error)
+// characterClasses are the characters with a class of their own, letters, digits and white space not mentioned here
+// get the class of their kind
+var characterClasses = map[string]int{
+	"\n":     CC_NEWLINE,
+	"acdACD": CC_HEX_LETTER,
+	"bB":     CC_B,
+	"eE":     CC_E,
+	"fF":     CC_F,
+	"oO":     CC_O,
+	"xX":     CC_X,
+	"_":      CC_UNDERSCORE,
+	"0":      CC_ZERO,
+	"1":      CC_ONE,
+	"234567": CC_OCTAL,
+	"89":     CC_DECIMAL,
+	".":      CC_DOT,
+	"-":      CC_MINUS,
+	"+":      CC_PLUS,
+	"@":      CC_AT,
+	"\"":     CC_QUOTE,
+	"'":      CC_APOSTROPHE,
+	"\\":     CC_BACKSLASH,
+	"/":      CC_SLASH,
+	"<":      CC_LESS,
+	">":      CC_GREATER,
+}
 
-// white_space skips over any empty stuff before anything actually happens
-func white_space(thisChar rune, thisToken Token) (state int, nextChar rune, nextToken Token, err error) {
-	if unicode.IsSpace(thisChar) {
-		nextChar, err = sourceCode.NextRune()
-		return
+// asciiClasses holds the class of every ASCII character, so most characters are classified by a single lookup
+var asciiClasses = asciiClassTable()
+
+func asciiClassTable() (table [utf8.RuneSelf]uint8) {
+	for c := range table {
+		table[c] = uint8(unicodeClass(rune(c)))
+	}
+	for c := range singleSymbols {
+		table[c] = CC_SYMBOL
+	}
+	for characters, class := range characterClasses {
+		for _, c := range characters {
+			table[c] = uint8(class)
+		}
 	}
-	nextChar = thisChar
-	nextToken = thisToken
-	state = ST_TOKEN_START
 	return
 }
 
-// token_start makes the initial categorization of the token
-func token_start(thisChar rune, thisToken Token) (state int, nextChar rune, nextToken Token, err error) {
-	// colon is a single symbol token all by itself
-	if thisChar == rune(':') {
-		nextToken.token = TK_COLON
-		nextChar, err = sourceCode.NextRune()
-		state = ST_END
-		return
-	}
-	// Brackets are single symbols all by themselves
-	if thisChar == rune('(') {
-		nextToken.token = TK_BRACKET_OPEN
-		nextChar, err = sourceCode.NextRune()
-		state = ST_END
-		return
-	}
-	if thisChar == rune(')') {
-		nextToken.token = TK_BRACKET_CLOSE
-		nextChar, err = sourceCode.NextRune()
-		state = ST_END
-		return
+// asciiSymbols holds the token of every single symbol, TK_UNKNOWN for the other ASCII characters
+var asciiSymbols = asciiSymbolTable()
+
+func asciiSymbolTable() (table [utf8.RuneSelf]int) {
+	for c, token := range singleSymbols {
+		table[c] = token
 	}
-	// Braces are single symbols all by themselves
-	if thisChar == rune('{') {
-		nextToken.token = TK_BRACE_OPEN
-		nextChar, err = sourceCode.NextRune()
-		state = ST_END
-		return
+	return
+}
+
+// unicodeClass classifies the characters that do not have a class of their own
+func unicodeClass(c rune) int {
+	switch {
+	case c == END_OF_FILE:
+		return CC_END_OF_FILE
+	case unicode.IsLetter(c):
+		return CC_LETTER
+	case unicode.IsDigit(c):
+		return CC_DIGIT
+	case unicode.IsSpace(c):
+		return CC_SPACE
 	}
-	if thisChar == rune('}') {
-		nextToken.token = TK_BRACE_CLOSE
-		nextChar, err = sourceCode.NextRune()
-		state = ST_END
-		return
+	return CC_OTHER
+}
+
+// classify returns the character class of a character
+func classify(c rune) int {
+	if c >= 0 && c < utf8.RuneSelf {
+		return int(asciiClasses[c])
 	}
-	// Comments starts with '//'
-	if thisChar == rune('/') {
-		nextChar, err = sourceCode.NextRune()
-		state = ST_COMMENT_START
-		return
+	return unicodeClass(c)
+}
+
+// the groups of character classes that are usually treated alike
+var (
+	letters   = []int{CC_LETTER, CC_HEX_LETTER, CC_B, CC_E, CC_F, CC_O, CC_X}
+	digits    = []int{CC_ZERO, CC_ONE, CC_OCTAL, CC_DECIMAL, CC_DIGIT}
+	hexDigits = []int{CC_ZERO, CC_ONE, CC_OCTAL, CC_DECIMAL, CC_HEX_LETTER, CC_B, CC_E, CC_F}
+)
+
+// - Tokenizer ------------------------------------------------------------------------------------------------------------------
+
+const (
+	ST_WHITE_SPACE     = iota // Reads leading whitespace before the token
+	ST_TOKEN_START            // Interprets the first character of the token
+	ST_COMMENT_START          // Tries to 'prove' a comment
+	ST_COMMENT                // Reads the comment
+	ST_IDENTIFIER             // Reads an identifier
+	ST_NEGATIVE               // Reads a negative number
+	ST_NUMBER_PREFIX          // Sorts out the type of number
+	ST_NUMBER                 // Reading decimals digits
+	ST_HEXADECIMAL            // reading hexadecimal digits
+	ST_FRACTION_START         // reading first decimal after dot
+	ST_FRACTION               // reading next decimals after dot
+	ST_STRING                 // reading the characters of a string
+	ST_STRING_ESCAPE          // reading the character after a backslash in a string
+	ST_CHAR                   // reading a character
+	ST_CHAR_ESCAPE            // reading the character after a backslash in a character
+	ST_BINARY                 // reading binary digits
+	ST_OCTAL                  // reading octal digits
+	ST_EXPONENT_START         // reading the sign or first digit after the 'e'
+	ST_EXPONENT_SIGN          // reading the first digit after the sign of the exponent
+	ST_EXPONENT               // reading the next digits of the exponent
+	ST_SHIFT_LEFT             // reading the second '<'
+	ST_SHIFT_RIGHT            // reading the second '>'
+	ST_ANONYMOUS              // reading the character after '@'
+	ST_DOT                    // reading the character after a leading dot, a directive or a float between <0..1>
+	ST_NEGATIVE_PREFIX        // Sorts out the type of a negative number
+	ST_QUALIFIED              // reading the first character of a local label after `global.`
+	ST_END             = 999  // Token read, all is well
+)
+
+const (
+	AC_KEEP   = iota // Leave the character for the next state
+	AC_READ          // Read past the character
+	AC_SYMBOL        // Read past the character, it is a token all by itself
+	AC_ERROR         // The character does not fit in the token
+)
+
+// Transition is what the lexer does with a character in a state
+type Transition struct {
+	action int    // one of the AC_ actions
+	state  int    // the next state, ST_END when the token is complete
+	token  int    // the token that is complete
+	err    string // the error for AC_ERROR, a %c shows the character
+}
+
+// move goes to the next state
+func move(action int, state int) Transition {
+	return Transition{action: action, state: state}
+}
+
+// emit completes the token without reading the character, it belongs to the next token
+func emit(token int) Transition {
+	return Transition{action: AC_KEEP, state: ST_END, token: token}
+}
+
+// accept completes the token with the character
+func accept(token int) Transition {
+	return Transition{action: AC_READ, state: ST_END, token: token}
+}
+
+func fail(err string) Transition {
+	return Transition{action: AC_ERROR, err: err}
+}
+
+// Rule gives the transition of a state for a number of character classes
+type Rule struct {
+	state      int
+	classes    []int // nil for all classes, the rules after it make the exceptions
+	transition Transition
+}
+
+// rules describe the state machine, a rule overrides the rules before it
+var rules = []Rule{
+	{ST_WHITE_SPACE, nil, move(AC_KEEP, ST_TOKEN_START)},
+	{ST_WHITE_SPACE, []int{CC_SPACE}, move(AC_READ, ST_WHITE_SPACE)},
+
+	{ST_TOKEN_START, nil, fail("unknown token")},
+	{ST_TOKEN_START, []int{CC_SYMBOL, CC_PLUS}, Transition{action: AC_SYMBOL, state: ST_END}},
+	{ST_TOKEN_START, []int{CC_AT}, move(AC_READ, ST_ANONYMOUS)},
+	{ST_TOKEN_START, []int{CC_LESS}, move(AC_READ, ST_SHIFT_LEFT)},
+	{ST_TOKEN_START, []int{CC_GREATER}, move(AC_READ, ST_SHIFT_RIGHT)},
+	{ST_TOKEN_START, []int{CC_QUOTE}, move(AC_READ, ST_STRING)},
+	{ST_TOKEN_START, []int{CC_APOSTROPHE}, move(AC_READ, ST_CHAR)},
+	{ST_TOKEN_START, []int{CC_SLASH}, move(AC_READ, ST_COMMENT_START)},
+	{ST_TOKEN_START, letters, move(AC_READ, ST_IDENTIFIER)},
+	{ST_TOKEN_START, []int{CC_UNDERSCORE}, move(AC_READ, ST_IDENTIFIER)},
+	{ST_TOKEN_START, []int{CC_MINUS}, move(AC_READ, ST_NEGATIVE)},
+	{ST_TOKEN_START, []int{CC_DOT}, move(AC_READ, ST_DOT)},
+	{ST_TOKEN_START, digits, move(AC_READ, ST_NUMBER)},
+	{ST_TOKEN_START, []int{CC_ZERO}, move(AC_READ, ST_NUMBER_PREFIX)},
+	{ST_TOKEN_START, []int{CC_NEWLINE}, accept(TK_END_OF_LINE)},
+	{ST_TOKEN_START, []int{CC_END_OF_FILE}, accept(TK_END_OF_FILE)}, // read again by every next token
+
+	{ST_COMMENT_START, nil, emit(TK_SLASH)},
+	{ST_COMMENT_START, []int{CC_SLASH}, move(AC_READ, ST_COMMENT)},
+
+	{ST_COMMENT, nil, move(AC_READ, ST_COMMENT)},
+	{ST_COMMENT, []int{CC_NEWLINE}, accept(TK_END_OF_LINE)},
+	{ST_COMMENT, []int{CC_END_OF_FILE}, move(AC_KEEP, ST_TOKEN_START)},
+
+	{ST_IDENTIFIER, nil, emit(TK_IDENTIFIER)},
+	{ST_IDENTIFIER, letters, move(AC_READ, ST_IDENTIFIER)},
+	{ST_IDENTIFIER, digits, move(AC_READ, ST_IDENTIFIER)},
+	{ST_IDENTIFIER, []int{CC_UNDERSCORE, CC_MINUS}, move(AC_READ, ST_IDENTIFIER)},
+	{ST_IDENTIFIER, []int{CC_DOT}, move(AC_READ, ST_QUALIFIED)},
+
+	// a reference to a local label under another global label, like `start.loop`
+	{ST_QUALIFIED, nil, fail("invalid token (expected the name of a local label after '.')")},
+	{ST_QUALIFIED, letters, move(AC_READ, ST_IDENTIFIER)},
+	{ST_QUALIFIED, []int{CC_UNDERSCORE}, move(AC_READ, ST_IDENTIFIER)},
+
+	{ST_NEGATIVE, nil, emit(TK_MINUS)},
+	{ST_NEGATIVE, digits, move(AC_READ, ST_NUMBER)},
+	{ST_NEGATIVE, []int{CC_ZERO}, move(AC_READ, ST_NEGATIVE_PREFIX)},
+
+	// unlike a positive number, a negative one may continue with digits after the 0
+	{ST_NEGATIVE_PREFIX, nil, emit(TK_INTEGER)},
+	{ST_NEGATIVE_PREFIX, digits, move(AC_READ, ST_NUMBER)},
+	{ST_NEGATIVE_PREFIX, []int{CC_DOT}, move(AC_READ, ST_FRACTION_START)},
+	{ST_NEGATIVE_PREFIX, []int{CC_X}, move(AC_READ, ST_HEXADECIMAL)},
+	{ST_NEGATIVE_PREFIX, []int{CC_B}, move(AC_READ, ST_BINARY)},
+	{ST_NEGATIVE_PREFIX, []int{CC_O}, move(AC_READ, ST_OCTAL)},
+	{ST_NEGATIVE_PREFIX, []int{CC_UNDERSCORE}, move(AC_READ, ST_NUMBER)},
+	{ST_NEGATIVE_PREFIX, []int{CC_E}, move(AC_READ, ST_EXPONENT_START)},
+
+	{ST_NUMBER_PREFIX, nil, emit(TK_INTEGER)},
+	{ST_NUMBER_PREFIX, []int{CC_DOT}, move(AC_READ, ST_FRACTION_START)},
+	{ST_NUMBER_PREFIX, []int{CC_X}, move(AC_READ, ST_HEXADECIMAL)},
+	{ST_NUMBER_PREFIX, []int{CC_B}, move(AC_READ, ST_BINARY)},
+	{ST_NUMBER_PREFIX, []int{CC_O}, move(AC_READ, ST_OCTAL)},
+	{ST_NUMBER_PREFIX, []int{CC_UNDERSCORE}, move(AC_READ, ST_NUMBER)},
+	{ST_NUMBER_PREFIX, []int{CC_E}, move(AC_READ, ST_EXPONENT_START)},
+
+	{ST_NUMBER, nil, emit(TK_INTEGER)},
+	{ST_NUMBER, digits, move(AC_READ, ST_NUMBER)},
+	{ST_NUMBER, []int{CC_UNDERSCORE}, move(AC_READ, ST_NUMBER)},
+	{ST_NUMBER, []int{CC_DOT}, move(AC_READ, ST_FRACTION_START)},
+	{ST_NUMBER, []int{CC_E}, move(AC_READ, ST_EXPONENT_START)},
+
+	{ST_HEXADECIMAL, nil, emit(TK_HEXADECIMAL)},
+	{ST_HEXADECIMAL, hexDigits, move(AC_READ, ST_HEXADECIMAL)},
+	{ST_HEXADECIMAL, []int{CC_UNDERSCORE}, move(AC_READ, ST_HEXADECIMAL)},
+
+	{ST_BINARY, nil, emit(TK_BINARY)},
+	{ST_BINARY, []int{CC_OCTAL, CC_DECIMAL, CC_DIGIT}, fail("invalid token (digit '%c' in binary number)")},
+	{ST_BINARY, []int{CC_ZERO, CC_ONE}, move(AC_READ, ST_BINARY)},
+	{ST_BINARY, []int{CC_UNDERSCORE}, move(AC_READ, ST_BINARY)},
+
+	{ST_OCTAL, nil, emit(TK_OCTAL)},
+	{ST_OCTAL, []int{CC_DECIMAL, CC_DIGIT}, fail("invalid token (digit '%c' in octal number)")},
+	{ST_OCTAL, []int{CC_ZERO, CC_ONE, CC_OCTAL}, move(AC_READ, ST_OCTAL)},
+	{ST_OCTAL, []int{CC_UNDERSCORE}, move(AC_READ, ST_OCTAL)},
+
+	{ST_DOT, nil, fail("invalid token (expected decimal)")},
+	{ST_DOT, digits, move(AC_READ, ST_FRACTION)},
+	{ST_DOT, letters, move(AC_READ, ST_IDENTIFIER)},
+	{ST_DOT, []int{CC_UNDERSCORE}, move(AC_READ, ST_IDENTIFIER)},
+
+	{ST_FRACTION_START, nil, fail("invalid token (expected decimal)")},
+	{ST_FRACTION_START, digits, move(AC_READ, ST_FRACTION)},
+
+	{ST_FRACTION, nil, emit(TK_FLOAT)},
+	{ST_FRACTION, digits, move(AC_READ, ST_FRACTION)},
+	{ST_FRACTION, []int{CC_E}, move(AC_READ, ST_EXPONENT_START)},
+
+	{ST_EXPONENT_START, nil, fail("invalid token (malformed exponent)")},
+	{ST_EXPONENT_START, []int{CC_MINUS, CC_PLUS}, move(AC_READ, ST_EXPONENT_SIGN)},
+	{ST_EXPONENT_START, digits, move(AC_READ, ST_EXPONENT)},
+
+	{ST_EXPONENT_SIGN, nil, fail("invalid token (malformed exponent)")},
+	{ST_EXPONENT_SIGN, digits, move(AC_READ, ST_EXPONENT)},
+
+	{ST_EXPONENT, nil, emit(TK_FLOAT)},
+	{ST_EXPONENT, digits, move(AC_READ, ST_EXPONENT)},
+
+	{ST_STRING, nil, move(AC_READ, ST_STRING)},
+	{ST_STRING, []int{CC_QUOTE}, accept(TK_STRING)},
+	{ST_STRING, []int{CC_BACKSLASH}, move(AC_READ, ST_STRING_ESCAPE)},
+	{ST_STRING, []int{CC_NEWLINE, CC_END_OF_FILE}, fail("invalid token (unterminated string)")},
+
+	{ST_STRING_ESCAPE, nil, move(AC_READ, ST_STRING)},
+	{ST_STRING_ESCAPE, []int{CC_NEWLINE, CC_END_OF_FILE}, fail("invalid token (unterminated string)")},
+
+	{ST_CHAR, nil, move(AC_READ, ST_CHAR)},
+	{ST_CHAR, []int{CC_APOSTROPHE}, accept(TK_CHAR)},
+	{ST_CHAR, []int{CC_BACKSLASH}, move(AC_READ, ST_CHAR_ESCAPE)},
+	{ST_CHAR, []int{CC_NEWLINE, CC_END_OF_FILE}, fail("invalid token (unterminated character)")},
+
+	{ST_CHAR_ESCAPE, nil, move(AC_READ, ST_CHAR)},
+	{ST_CHAR_ESCAPE, []int{CC_NEWLINE, CC_END_OF_FILE}, fail("invalid token (unterminated character)")},
+
+	{ST_SHIFT_LEFT, nil, fail("unknown token (expected '<<')")},
+	{ST_SHIFT_LEFT, []int{CC_LESS}, accept(TK_SHIFT_LEFT)},
+
+	{ST_SHIFT_RIGHT, nil, fail("unknown token (expected '>>')")},
+	{ST_SHIFT_RIGHT, []int{CC_GREATER}, accept(TK_SHIFT_RIGHT)},
+
+	// an anonymous label `@@`, or a reference to the next `@f` or the previous `@b` one
+	{ST_ANONYMOUS, nil, fail("unknown token (expected '@@', '@f' or '@b')")},
+	{ST_ANONYMOUS, []int{CC_AT, CC_B, CC_F}, accept(TK_IDENTIFIER)},
+}
+
+// transitions is the state machine as a table, indexed by state and character class
+var transitions = transitionTable(rules)
+
+func transitionTable(rules []Rule) (table [][CC_COUNT]Transition) {
+	for _, rule := range rules {
+		for rule.state >= len(table) {
+			table = append(table, [CC_COUNT]Transition{})
+		}
+		if rule.classes == nil {
+			for class := range table[rule.state] {
+				table[rule.state][class] = rule.transition
+			}
+		}
+		for _, class := range rule.classes {
+			table[rule.state][class] = rule.transition
+		}
 	}
-	// an identifier has started
-	if unicode.IsLetter(thisChar) || thisChar == rune('_') {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_IDENTIFIER
-		return
+	return
+}
+
+// runs are the ASCII characters every state reads past without changing state, a run of them can be read from the
+// source code at once. A '\r' is never part of a run, NextRune has to turn it into a '\n'.
+var runs = runTable(transitions)
+
+func runTable(transitions [][CC_COUNT]Transition) (table [][utf8.RuneSelf]bool) {
+	table = make([][utf8.RuneSelf]bool, len(transitions))
+	for state := range transitions {
+		for c, class := range asciiClasses {
+			table[state][c] = c != '\r' && transitions[state][class] == move(AC_READ, state)
+		}
 	}
-	// a negative number has started
-	if thisChar == rune('-') {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_NEGATIVE
+	return
+}
+
+// Finish checks the text of a complete token, it may also change the kind of token
+type Finish func(thisToken int, text []byte) (nextToken int, err error)
+
+// finishers are the tokens that need more than the state machine to be checked, nil for the tokens that do not
+var finishers = [...]Finish{
+	TK_IDENTIFIER:  identifier_token,
+	TK_HEXADECIMAL: hexadecimal_token,
+	TK_BINARY:      binary_token,
+	TK_OCTAL:       octal_token,
+	TK_STRING:      string_token,
+	TK_CHAR:        char_token,
+}
+
+// Lexer turns source code into tokens. Every lexer owns its source code, so an included file or a definition from the
+// command line simply gets a lexer of its own.
+type Lexer struct {
+	source *SourceCode
+	line   []Token // the tokens of the last line read, reused for the next line
+}
+
+// atEnd reports if all of the source code has been read
+func (l *Lexer) atEnd() bool {
+	return l.source.AtEnd()
+}
+
+// fileName returns the name of the file being read, empty for source code that did not come from a file
+func (l *Lexer) fileName() string {
+	return l.source.file
+}
+
+func NewLexer(source *SourceCode) (l *Lexer) {
+	l = &Lexer{source: source}
+	return
+}
+
+// step makes the transition of the state for a single character, the token is known once the state is ST_END
+func (l *Lexer) step(state int, thisChar rune) (nextState int, nextChar rune, token int, err error) {
+	transition := &transitions[state][classify(thisChar)]
+	nextChar = thisChar
+	token = transition.token // TK_UNKNOWN until the token is complete
+	switch transition.action {
+	case AC_SYMBOL:
+		token = asciiSymbols[thisChar]
+	case AC_ERROR:
+		if strings.Contains(transition.err, "%c") {
+			err = fmt.Errorf(transition.err, thisChar)
+		} else {
+			err = fmt.Errorf("%s", transition.err)
+		}
 		return
 	}
-	// a float between <0..1> has started
-	if thisChar == rune('.') {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_FRACTION_START
-		return
+	if transition.action != AC_KEEP {
+		nextChar, err = l.source.NextRune()
 	}
-	// a Hexadecimal or Float number may have started
-	if thisChar == rune('0') {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_NUMBER_PREFIX
-		return
+	nextState = transition.state
+	return
+}
+
+// finish checks a complete token
+func (l *Lexer) finish(thisToken int, text []byte) (nextToken int, err error) {
+	nextToken = thisToken
+	if thisToken < len(finishers) && finishers[thisToken] != nil {
+		nextToken, err = finishers[thisToken](thisToken, text)
 	}
-	// a number has started
-	if unicode.IsDigit(thisChar) {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_NUMBER
+	return
+}
+
+// identifier_token turns the identifier into a keyword or one of the special float values when it is one
+func identifier_token(thisToken int, text []byte) (nextToken int, err error) {
+	nextToken = thisToken
+	if len(text) > KEYWORD_MAX_LENGTH {
 		return
 	}
-	// End of line is a token all by itself
-	if thisChar == rune('\n') {
-		nextToken.token = TK_END_OF_LINE
-		nextChar, err = sourceCode.NextRune()
-		state = ST_END
-		return
+	name := string(text) // short enough to stay on the stack
+	nextToken = keyword(name)
+	if isSpecialFloat(name) {
+		nextToken = TK_FLOAT
 	}
-	err = fmt.Errorf("unknown token")
 	return
 }
 
-// comment_start checks if there is a second '/' if not, we stop
-func comment_start(thisChar rune, _ Token) (state int, nextChar rune, nextToken Token, err error) {
-	if thisChar == rune('/') {
-		nextChar, err = sourceCode.NextRune()
-		state = ST_COMMENT
-		return
-	}
-	err = fmt.Errorf("unknown token (expected '/')")
+// hexadecimal_token checks there is at least one digit after the prefix
+func hexadecimal_token(thisToken int, text []byte) (nextToken int, err error) {
+	nextToken, err = prefixedToken(thisToken, text, "hexadecimal")
 	return
 }
 
-// comment skips the content of the comment until EOLN
-func comment(thisChar rune, _ Token) (state int, nextChar rune, nextToken Token, err error) {
-	if thisChar != rune('\n') {
-		nextChar, err = sourceCode.NextRune()
-		state = ST_COMMENT
-		return
-	}
-	nextChar, err = sourceCode.NextRune()
-	nextToken.token = TK_END_OF_LINE
-	state = ST_END
+// binary_token checks there is at least one digit after the prefix
+func binary_token(thisToken int, text []byte) (nextToken int, err error) {
+	nextToken, err = prefixedToken(thisToken, text, "binary")
 	return
 }
 
-// identifierToken reads the rest of an identifier
-func identifier(thisChar rune, thisToken Token) (state int, nextChar rune, nextToken Token, err error) {
-	// the identifier continues
-	if unicode.IsLetter(thisChar) || unicode.IsDigit(thisChar) || thisChar == rune('_') || thisChar == rune('-') {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_IDENTIFIER
-		return
-	}
-	// the identifier is done
-	nextToken.token = TK_IDENTIFIER
-	nextToken.value = thisToken.value
-	nextChar = thisChar
-	state = ST_END
+// octal_token checks there is at least one digit after the prefix
+func octal_token(thisToken int, text []byte) (nextToken int, err error) {
+	nextToken, err = prefixedToken(thisToken, text, "octal")
 	return
 }
 
-// negativeNumberToken reads the rest of a negative number
-func negative(thisChar rune, thisToken Token) (state int, nextChar rune, nextToken Token, err error) {
-	// This must be a digit
-	if unicode.IsDigit(thisChar) {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_NUMBER
-		return
+// prefixedToken checks a number with a prefix, which needs at least one digit after the prefix
+func prefixedToken(thisToken int, text []byte, kind string) (nextToken int, err error) {
+	nextToken = thisToken
+	_, number := prefixedDigits(text)
+	if len(bytes.Trim(number, "_")) == 0 {
+		err = fmt.Errorf("invalid token (%s number without digits)", kind)
 	}
-	// oops
-	err = fmt.Errorf("invalid token (malformed number)")
 	return
 }
 
-// number_prefix checks if we are reading a hexadecimal number or a float that happens to start with '0'
-func number_prefix(thisChar rune, thisToken Token) (state int, nextChar rune, nextToken Token, err error) {
-	// Check if it is a floating point number
-	if thisChar == rune('.') {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_FRACTION_START
-		return
-	}
-	// Check if it is a hexadecimal number
-	if thisChar == rune('x') || thisChar == rune('X') {
-		nextToken.value = "" // the value is without the 0X prefix
-		nextChar, err = sourceCode.NextRune()
-		state = ST_HEXADECIMAL
-		return
+// string_token checks the escape sequences of the string
+func string_token(thisToken int, text []byte) (nextToken int, err error) {
+	nextToken = thisToken
+	_, err = countCharacters(unquoted(text))
+	if err != nil {
+		err = fmt.Errorf("invalid token (%s in string)", err.Error())
 	}
-	// It's just a 0, the number is done
-	nextToken.token = TK_INTEGER
-	nextToken.value = thisToken.value
-	nextChar = thisChar
-	state = ST_END
 	return
 }
 
-// number reads the whole part of a number
-func number(thisChar rune, thisToken Token) (state int, nextChar rune, nextToken Token, err error) {
-	// This must be a digit
-	if unicode.IsDigit(thisChar) {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_NUMBER
+// char_token checks the escape sequences of the character, after which it must be a single character
+func char_token(thisToken int, text []byte) (nextToken int, err error) {
+	nextToken = thisToken
+	count, err := countCharacters(unquoted(text))
+	if err != nil {
+		err = fmt.Errorf("invalid token (%s in character)", err.Error())
 		return
 	}
-	// Cloud be float
-	if thisChar == rune('.') {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_FRACTION_START
-		return
+	if count != 1 {
+		err = fmt.Errorf("invalid token (character should be exactly one character)")
 	}
-	// the number is done
-	nextToken.token = TK_INTEGER
-	nextToken.value = thisToken.value
-	nextChar = thisChar
-	state = ST_END
 	return
 }
 
-// hexadecimal reacs all hexadecimal digits
-func hexadecimal(thisChar rune, thisToken Token) (state int, nextChar rune, nextToken Token, err error) {
+// isSpecialFloat checks for the names of the special float values: infinity and not-a-number
+func isSpecialFloat(value string) bool {
+	return strings.EqualFold(value, "inf") || strings.EqualFold(value, "nan")
+}
 
-	hexadecimals := unicode.RangeTable{
-		R16: []unicode.Range16{
-			{Lo: uint16(rune('0')), Hi: uint16(rune('9')), Stride: 1},
-			{Lo: uint16(rune('A')), Hi: uint16(rune('F')), Stride: 1},
-			{Lo: uint16(rune('a')), Hi: uint16(rune('f')), Stride: 1},
-		},
+// unescape decodes the escape sequences in a string or character, like \n, \t, \x41, \u00e9, \\, \" and \'
+func unescape(raw string) (value string, err error) {
+	var builder strings.Builder
+	for len(raw) > 0 {
+		var c rune
+		var isByte bool
+		c, isByte, raw, err = nextCharacter(raw)
+		if err != nil {
+			return
+		}
+		if isByte {
+			builder.WriteByte(byte(c))
+		} else {
+			builder.WriteRune(c)
+		}
 	}
+	value = builder.String()
+	return
+}
 
-	// This must be a hexadecimal digit
-	if unicode.Is(&hexadecimals, thisChar) {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_HEXADECIMAL
-		return
+// decode returns the values of the characters of a string or character. A \x escape is a byte of its own, it keeps its
+// byte value even when it forms a UTF-8 character together with the escapes next to it.
+func decode(raw string) (values []int64, err error) {
+	for len(raw) > 0 {
+		var c rune
+		c, _, raw, err = nextCharacter(raw)
+		if err != nil {
+			return
+		}
+		values = append(values, int64(c))
 	}
-
-	// hexadecimal is done
-	nextToken.token = TK_HEXADECIMAL
-	nextToken.value = thisToken.value
-	nextChar = thisChar
-	state = ST_END
 	return
 }
 
-func fraction_start(thisChar rune, thisToken Token) (state int, nextChar rune, nextToken Token, err error) {
-	// This must be a digit
-	if unicode.IsDigit(thisChar) {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_FRACTION
+// countCharacters counts the characters of a string or character, like decode but without keeping their values
+func countCharacters(raw string) (count int, err error) {
+	if !strings.ContainsAny(raw, "\\\"") { // nothing to unquote, every rune is a character
+		count = utf8.RuneCountInString(raw)
 		return
 	}
-	err = fmt.Errorf("invalid token (expected decimal)")
+	for len(raw) > 0 {
+		_, _, raw, err = nextCharacter(raw)
+		if err != nil {
+			return
+		}
+		count++
+	}
 	return
 }
 
-func fraction(thisChar rune, thisToken Token) (state int, nextChar rune, nextToken Token, err error) {
-	// This must be a digit
-	if unicode.IsDigit(thisChar) {
-		nextToken = thisToken.append(thisChar)
-		nextChar, err = sourceCode.NextRune()
-		state = ST_FRACTION
+// nextCharacter decodes the first character of a string or character, a \x escape produces a byte instead
+func nextCharacter(raw string) (c rune, isByte bool, rest string, err error) {
+	quote := byte('"')
+	if strings.HasPrefix(raw, "\\'") {
+		quote = byte('\'')
+	}
+	c, multibyte, rest, err := strconv.UnquoteChar(raw, quote)
+	if err != nil {
+		err = fmt.Errorf("invalid escape sequence")
 		return
 	}
-	// the float is done
-	nextToken.token = TK_FLOAT
-	nextToken.value = thisToken.value
-	nextChar = thisChar
-	state = ST_END
+	isByte = c < utf8.RuneSelf || !multibyte
 	return
 }
 
-// nextToken reads the next token from the buffer, using a classic handcrafted state machine.
-func nextToken() (token Token, err error) {
-
-	stateTable := []State{
-		white_space,
-		token_start,
-		comment_start,
-		comment,
-		identifier,
-		negative,
-		number_prefix,
-		number,
-		hexadecimal,
-		fraction_start,
-		fraction}
-
-	state := 0
+// NextToken reads the next token from the source code, driving the state machine with one character at a time. A run
+// of characters that leaves the state as it is, is read at once. The text of the token is a span of the source code,
+// nothing is copied. After an error the offending rune is left unread, so the caller can decide how to recover.
+func (l *Lexer) NextToken() (token Token, err error) {
+	state := ST_WHITE_SPACE
 	token = NewToken()
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := l.source.NextRune()
 	for err == nil && state != ST_END {
-		state, thisChar, token, err = stateTable[state](thisChar, token)
+		if state == ST_TOKEN_START {
+			l.source.positionOf(&token.start)
+			l.source.startSpan()
+		}
+		if thisChar >= 0 && thisChar < utf8.RuneSelf && runs[state][thisChar] {
+			thisChar, err = l.source.NextRun(&runs[state])
+			continue
+		}
+		state, thisChar, token.token, err = l.step(state, thisChar)
 	}
 	if err == nil {
-		sourceCode.PrevRune()
+		l.source.positionOf(&token.end)
+		token.text = l.source.endSpan(token.end.offset - token.start.offset)
+		token.token, err = l.finish(token.token, token.text)
 	}
+	if err != nil {
+		err = NewSourceError(token.start, "%s", err.Error())
+		l.source.PrevRune()
+		return
+	}
+	l.source.PrevRune()
+
+	return
+}
 
+// skipLine recovers from an error by skipping everything up to the end of the line, the end of line or file itself is
+// left for the next token.
+func (l *Lexer) skipLine() (err error) {
+	thisChar, err := l.source.NextRune()
+	for err == nil && thisChar != rune('\n') && thisChar != END_OF_FILE {
+		thisChar, err = l.source.NextRune()
+	}
+	if err == nil {
+		err = l.source.PrevRune()
+	}
 	return
 }
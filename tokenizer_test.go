@@ -1,19 +1,28 @@
-package main
+package assembler
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
 // - Support functions to prevent repetition ------------------------------------------------------------------------------------
 
+// newLexer creates a lexer for the source code in the string
+func newLexer(sourceCode string) (lexer *Lexer) {
+	source := NewSourceCode()
+	source.LoadString(sourceCode)
+	lexer = NewLexer(source)
+	return
+}
+
 type StateCase struct {
 	expectedChar  rune
 	expectedState int
 	expectedToken int
-	expectedValue string
 }
 
-func (c StateCase) verify(t *testing.T, caseId int, state int, nextChar rune, token Token, err error) {
+func (c StateCase) verify(t *testing.T, caseId int, state int, nextChar rune, token int, err error) {
 	if err != nil {
 		t.Errorf("CaseID %d: %v", caseId, err.Error())
 	}
@@ -23,11 +32,8 @@ func (c StateCase) verify(t *testing.T, caseId int, state int, nextChar rune, to
 	if state != c.expectedState {
 		t.Errorf("CaseID %d: wrong state, expected %d, got %d", caseId, c.expectedState, state)
 	}
-	if token.token != c.expectedToken {
-		t.Errorf("CaseID %d: wrong token, expected %d, got %d", caseId, c.expectedToken, token.token)
-	}
-	if token.value != c.expectedValue {
-		t.Errorf("CaseID %d: wrong value, expected \"%s\", got \"%s\"", caseId, c.expectedValue, token.value)
+	if token != c.expectedToken {
+		t.Errorf("CaseID %d: wrong token, expected %d, got %d", caseId, c.expectedToken, token)
 	}
 }
 
@@ -39,22 +45,21 @@ type TokenizerCase struct {
 }
 
 func (c TokenizerCase) verify(t *testing.T, caseId int) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString(c.sourceCode)
+	lexer := newLexer(c.sourceCode)
 
 	// Read token
-	token, err := nextToken()
+	token, err := lexer.NextToken()
 	if err != nil {
 		t.Errorf("error: %s", err.Error())
 	}
 	if token.token != c.expectedToken {
 		t.Errorf("wrong token: expected %d, got %d", c.expectedToken, token.token)
 	}
-	if token.value != c.expectedValue {
-		t.Errorf("wrong value: expected \"%s\", got \"%s\"", c.expectedValue, token.value)
+	if token.Value() != c.expectedValue {
+		t.Errorf("wrong value: expected \"%s\", got \"%s\"", c.expectedValue, token.Value())
 	}
 	// Check we start off ok, next time
-	nextChar, err := sourceCode.NextRune()
+	nextChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf("error: %s", err.Error())
 	}
@@ -70,366 +75,650 @@ func TestNewToken(t *testing.T) {
 	if token.token != TK_UNKNOWN {
 		t.Errorf("wrong token, expected %d, got %d", TK_UNKNOWN, token.token)
 	}
-	if token.value != "" {
-		t.Errorf("wrong value, expected \"\", got \"%s\"", token.value)
+	if token.Value() != "" {
+		t.Errorf("wrong value, expected \"\", got \"%s\"", token.Value())
 	}
 }
 
-func TestAppend(t *testing.T) {
-	token := NewToken()
-	token = token.append(rune('A'))
-	if token.token != TK_UNKNOWN {
-		t.Errorf("wrong token, expected %d, got %d", TK_UNKNOWN, token.token)
+func TestTokenValue(t *testing.T) {
+	testCases := []struct {
+		token         int
+		text          string
+		expectedValue string
+	}{
+		{TK_IDENTIFIER, "start", "start"},
+		{TK_IDENTIFIER, "@F", "@f"},
+		{TK_MNEMONIC, "JMP", "JMP"},
+		{TK_INTEGER, "1_000", "1000"},
+		{TK_FLOAT, "-2.5e+3", "-2.5e+3"},
+		{TK_HEXADECIMAL, "-0xFF_FF", "-FFFF"},
+		{TK_BINARY, "0b1", "1"},
+		{TK_OCTAL, "0O7_7", "77"},
+		{TK_STRING, "\"a\\n\"", "a\n"},
+		{TK_CHAR, "'\\''", "'"},
+		{TK_COLON, ":", ""},
 	}
-	if token.value != "A" {
-		t.Errorf("wrong value, expected \"A\", got \"%s\"", token.value)
+	for i, c := range testCases {
+		token := Token{token: c.token, text: []byte(c.text)}
+		if token.Value() != c.expectedValue {
+			t.Errorf("CaseID %d: wrong value, expected \"%s\", got \"%s\"", i, c.expectedValue, token.Value())
+		}
+		if token.Text() != c.text {
+			t.Errorf("CaseID %d: wrong text, expected \"%s\", got \"%s\"", i, c.text, token.Text())
+		}
 	}
 }
 
-// - Test state functions -------------------------------------------------------------------------------------------------------
+// - Test state transitions -----------------------------------------------------------------------------------------------------
+
+func TestClassify(t *testing.T) {
+	testCases := []struct {
+		char          rune
+		expectedClass int
+	}{
+		{' ', CC_SPACE},
+		{'\t', CC_SPACE},
+		{'\n', CC_NEWLINE},
+		{END_OF_FILE, CC_END_OF_FILE},
+		{':', CC_SYMBOL},
+		{'~', CC_SYMBOL},
+		{'+', CC_PLUS},
+		{'g', CC_LETTER},
+		{'é', CC_LETTER},
+		{'A', CC_HEX_LETTER},
+		{'b', CC_B},
+		{'E', CC_E},
+		{'f', CC_F},
+		{'O', CC_O},
+		{'x', CC_X},
+		{'0', CC_ZERO},
+		{'1', CC_ONE},
+		{'7', CC_OCTAL},
+		{'9', CC_DECIMAL},
+		{'٣', CC_DIGIT},
+		{'\u00a0', CC_SPACE},
+		{'!', CC_OTHER},
+		{'$', CC_OTHER},
+	}
+	for i, c := range testCases {
+		if class := classify(c.char); class != c.expectedClass {
+			t.Errorf("CaseID %d: wrong class for %q, expected %d, got %d", i, c.char, c.expectedClass, class)
+		}
+	}
+}
 
 func TestWhiteSpace(t *testing.T) {
 
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString(" X")
+	lexer := newLexer(" X")
 
 	testCases := []StateCase{
-		{rune('X'), ST_WHITE_SPACE, TK_UNKNOWN, ""},
-		{rune('X'), ST_TOKEN_START, TK_UNKNOWN, ""}}
+		{rune('X'), ST_WHITE_SPACE, TK_UNKNOWN},
+		{rune('X'), ST_TOKEN_START, TK_UNKNOWN}}
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	state := ST_WHITE_SPACE
-	token := NewToken()
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = white_space(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_WHITE_SPACE, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
 	}
 }
 
 func TestTokenStart(t *testing.T) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString(":(){}/Aa_-.07\n")
+	lexer := newLexer(":(){}/Aa_-.07\n")
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	testCases := []StateCase{
-		{rune('('), ST_END, TK_COLON, ""},
-		{rune(')'), ST_END, TK_BRACKET_OPEN, ""},
-		{rune('{'), ST_END, TK_BRACKET_CLOSE, ""},
-		{rune('}'), ST_END, TK_BRACE_OPEN, ""},
-		{rune('/'), ST_END, TK_BRACE_CLOSE, ""},
-		{rune('A'), ST_COMMENT_START, TK_UNKNOWN, ""},
-		{rune('a'), ST_IDENTIFIER, TK_UNKNOWN, "A"},
-		{rune('_'), ST_IDENTIFIER, TK_UNKNOWN, "a"},
-		{rune('-'), ST_IDENTIFIER, TK_UNKNOWN, "_"},
-		{rune('.'), ST_NEGATIVE, TK_UNKNOWN, "-"},
-		{rune('0'), ST_FRACTION_START, TK_UNKNOWN, "."},
-		{rune('7'), ST_NUMBER_PREFIX, TK_UNKNOWN, "0"},
-		{rune('\n'), ST_NUMBER, TK_UNKNOWN, "7"},
-		{rune(0x04), ST_END, TK_END_OF_LINE, ""},
+		{rune('('), ST_END, TK_COLON},
+		{rune(')'), ST_END, TK_BRACKET_OPEN},
+		{rune('{'), ST_END, TK_BRACKET_CLOSE},
+		{rune('}'), ST_END, TK_BRACE_OPEN},
+		{rune('/'), ST_END, TK_BRACE_CLOSE},
+		{rune('A'), ST_COMMENT_START, TK_UNKNOWN},
+		{rune('a'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('_'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('-'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('.'), ST_NEGATIVE, TK_UNKNOWN},
+		{rune('0'), ST_DOT, TK_UNKNOWN},
+		{rune('7'), ST_NUMBER_PREFIX, TK_UNKNOWN},
+		{rune('\n'), ST_NUMBER, TK_UNKNOWN},
+		{END_OF_FILE, ST_END, TK_END_OF_LINE},
 	}
 
 	state := ST_TOKEN_START
-	token := NewToken()
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = token_start(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_TOKEN_START, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
-		token = token.clear()
 	}
 
-	_, _, _, err = token_start(rune('!'), token) // unknown
+	_, _, _, err = lexer.step(ST_TOKEN_START, rune('!')) // unknown
 	if err == nil {
 		t.Errorf("Expected \"unknown token\" error")
 	}
 }
 
 func TestCommentStart(t *testing.T) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString("/")
+	lexer := newLexer("/")
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	testCases := []StateCase{
-		{rune(0x04), ST_COMMENT, TK_UNKNOWN, ""}}
+		{END_OF_FILE, ST_COMMENT, TK_UNKNOWN}}
 
 	state := ST_COMMENT_START
-	token := NewToken()
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = comment(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_COMMENT_START, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
-		token = token.clear()
 	}
 
-	_, _, _, err = comment_start(rune('!'), token) // unknown
-	if err == nil {
-		t.Errorf("expected \"unknown token (expected '/')\" error")
-	}
+	testCase := StateCase{rune('!'), ST_END, TK_SLASH}
+	state, thisChar, token, err = lexer.step(ST_COMMENT_START, rune('!')) // division
+	testCase.verify(t, -1, state, thisChar, token, err)
 }
 
 func TestComment(t *testing.T) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString("Aa0_-.\n")
+	lexer := newLexer("Aa0_-.\n")
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	testCases := []StateCase{
-		{rune('a'), ST_COMMENT, TK_UNKNOWN, ""},
-		{rune('0'), ST_COMMENT, TK_UNKNOWN, ""},
-		{rune('_'), ST_COMMENT, TK_UNKNOWN, ""},
-		{rune('-'), ST_COMMENT, TK_UNKNOWN, ""},
-		{rune('.'), ST_COMMENT, TK_UNKNOWN, ""},
-		{rune('\n'), ST_COMMENT, TK_UNKNOWN, ""},
-		{rune(0x04), ST_END, TK_END_OF_LINE, ""}}
+		{rune('a'), ST_COMMENT, TK_UNKNOWN},
+		{rune('0'), ST_COMMENT, TK_UNKNOWN},
+		{rune('_'), ST_COMMENT, TK_UNKNOWN},
+		{rune('-'), ST_COMMENT, TK_UNKNOWN},
+		{rune('.'), ST_COMMENT, TK_UNKNOWN},
+		{rune('\n'), ST_COMMENT, TK_UNKNOWN},
+		{END_OF_FILE, ST_END, TK_END_OF_LINE}}
 
 	state := ST_COMMENT
-	token := NewToken()
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = comment(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_COMMENT, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
-		token = token.clear()
 	}
 }
 
 func TestIdentifier(t *testing.T) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString("AZaz09_-!")
+	lexer := newLexer("AZaz09_-!")
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	testCases := []StateCase{
-		{rune('Z'), ST_IDENTIFIER, TK_UNKNOWN, "A"},
-		{rune('a'), ST_IDENTIFIER, TK_UNKNOWN, "Z"},
-		{rune('z'), ST_IDENTIFIER, TK_UNKNOWN, "a"},
-		{rune('0'), ST_IDENTIFIER, TK_UNKNOWN, "z"},
-		{rune('9'), ST_IDENTIFIER, TK_UNKNOWN, "0"},
-		{rune('_'), ST_IDENTIFIER, TK_UNKNOWN, "9"},
-		{rune('-'), ST_IDENTIFIER, TK_UNKNOWN, "_"},
-		{rune('!'), ST_IDENTIFIER, TK_UNKNOWN, "-"},
-		{rune('!'), ST_END, TK_IDENTIFIER, ""},
+		{rune('Z'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('a'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('z'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('0'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('9'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('_'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('-'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('!'), ST_IDENTIFIER, TK_UNKNOWN},
+		{rune('!'), ST_END, TK_IDENTIFIER},
 	}
 
 	state := ST_IDENTIFIER
-	token := NewToken()
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = identifier(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_IDENTIFIER, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
-		token = token.clear()
 	}
 }
 
 func TestNegative(t *testing.T) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString(("09"))
+	lexer := newLexer(("09"))
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	testCases := []StateCase{
-		{rune('9'), ST_NUMBER, TK_UNKNOWN, "0"},
-		{rune(0x04), ST_NUMBER, TK_UNKNOWN, "9"},
+		{rune('9'), ST_NEGATIVE_PREFIX, TK_UNKNOWN},
+		{END_OF_FILE, ST_NUMBER, TK_UNKNOWN},
 	}
 
 	state := ST_NEGATIVE
-	token := NewToken()
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = negative(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_NEGATIVE, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
-		token = token.clear()
 	}
 
-	_, _, _, err = negative(rune('-'), token)
-	if err == nil {
-		t.Errorf("expected \"invalid token (malformed number)\" error")
-	}
+	testCase := StateCase{rune('-'), ST_END, TK_MINUS}
+	state, thisChar, token, err = lexer.step(ST_NEGATIVE, rune('-'))
+	testCase.verify(t, -1, state, thisChar, token, err)
 
-	_, _, _, err = negative(rune('!'), token)
-	if err == nil {
-		t.Errorf("expected \"invalid token (malformed number)\" error")
-	}
+	testCase = StateCase{rune('!'), ST_END, TK_MINUS}
+	state, thisChar, token, err = lexer.step(ST_NEGATIVE, rune('!'))
+	testCase.verify(t, -1, state, thisChar, token, err)
 }
 
 func TestNumberPrefix(t *testing.T) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString((".xX"))
+	lexer := newLexer((".xX"))
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	testCases := []StateCase{
-		{rune('x'), ST_FRACTION_START, TK_UNKNOWN, "."},
-		{rune('X'), ST_HEXADECIMAL, TK_UNKNOWN, ""},
-		{rune(0x04), ST_HEXADECIMAL, TK_UNKNOWN, ""},
+		{rune('x'), ST_FRACTION_START, TK_UNKNOWN},
+		{rune('X'), ST_HEXADECIMAL, TK_UNKNOWN},
+		{END_OF_FILE, ST_HEXADECIMAL, TK_UNKNOWN},
 	}
 
 	state := ST_NUMBER_PREFIX
-	token := NewToken()
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = number_prefix(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_NUMBER_PREFIX, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
-		token = token.clear()
 	}
 
-	testCase := StateCase{rune('-'), ST_END, TK_INTEGER, ""}
-	state, thisChar, token, err = number_prefix(rune('-'), token)
+	testCase := StateCase{rune('-'), ST_END, TK_INTEGER}
+	state, thisChar, token, err = lexer.step(ST_NUMBER_PREFIX, rune('-'))
 	testCase.verify(t, -1, state, thisChar, token, err)
-	token.clear()
 
-	testCase = StateCase{rune('!'), ST_END, TK_INTEGER, ""}
-	state, thisChar, token, err = number_prefix(rune('!'), token)
+	testCase = StateCase{rune('!'), ST_END, TK_INTEGER}
+	state, thisChar, token, err = lexer.step(ST_NUMBER_PREFIX, rune('!'))
 	testCase.verify(t, -1, state, thisChar, token, err)
-	token.clear()
 }
 
 func TestNumber(t *testing.T) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString(("09.!"))
+	lexer := newLexer(("09.!"))
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	testCases := []StateCase{
-		{rune('9'), ST_NUMBER, TK_UNKNOWN, "0"},
-		{rune('.'), ST_NUMBER, TK_UNKNOWN, "9"},
-		{rune('!'), ST_FRACTION_START, TK_UNKNOWN, "."},
-		{rune('!'), ST_END, TK_INTEGER, ""},
+		{rune('9'), ST_NUMBER, TK_UNKNOWN},
+		{rune('.'), ST_NUMBER, TK_UNKNOWN},
+		{rune('!'), ST_FRACTION_START, TK_UNKNOWN},
+		{rune('!'), ST_END, TK_INTEGER},
 	}
 
 	state := ST_NUMBER
-	token := NewToken()
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = number(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_NUMBER, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
-		token = token.clear()
 	}
 }
 
 func TestHexadecimal(t *testing.T) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString(("09afAF!"))
+	lexer := newLexer(("09afAF!"))
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	testCases := []StateCase{
-		{rune('9'), ST_HEXADECIMAL, TK_UNKNOWN, "0"},
-		{rune('a'), ST_HEXADECIMAL, TK_UNKNOWN, "9"},
-		{rune('f'), ST_HEXADECIMAL, TK_UNKNOWN, "a"},
-		{rune('A'), ST_HEXADECIMAL, TK_UNKNOWN, "f"},
-		{rune('F'), ST_HEXADECIMAL, TK_UNKNOWN, "A"},
-		{rune('!'), ST_HEXADECIMAL, TK_UNKNOWN, "F"},
-		{rune('!'), ST_END, TK_HEXADECIMAL, ""},
+		{rune('9'), ST_HEXADECIMAL, TK_UNKNOWN},
+		{rune('a'), ST_HEXADECIMAL, TK_UNKNOWN},
+		{rune('f'), ST_HEXADECIMAL, TK_UNKNOWN},
+		{rune('A'), ST_HEXADECIMAL, TK_UNKNOWN},
+		{rune('F'), ST_HEXADECIMAL, TK_UNKNOWN},
+		{rune('!'), ST_HEXADECIMAL, TK_UNKNOWN},
+		{rune('!'), ST_END, TK_HEXADECIMAL},
 	}
 
 	state := ST_HEXADECIMAL
-	token := NewToken()
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = hexadecimal(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_HEXADECIMAL, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
-		token = token.clear()
 	}
 
-	testCase := StateCase{rune('g'), ST_END, TK_HEXADECIMAL, ""}
-	state, thisChar, token, err = hexadecimal(rune('g'), token)
+	testCase := StateCase{rune('g'), ST_END, TK_HEXADECIMAL}
+	state, thisChar, token, err = lexer.step(ST_HEXADECIMAL, rune('g'))
 	testCase.verify(t, -1, state, thisChar, token, err)
-	token.clear()
 
-	testCase = StateCase{rune('G'), ST_END, TK_HEXADECIMAL, ""}
-	state, thisChar, token, err = hexadecimal(rune('G'), token)
+	testCase = StateCase{rune('G'), ST_END, TK_HEXADECIMAL}
+	state, thisChar, token, err = lexer.step(ST_HEXADECIMAL, rune('G'))
 	testCase.verify(t, -1, state, thisChar, token, err)
-	token.clear()
+
+	lexer = newLexer("nop\n\tpushi 0x_\n")
+	lexer.source.file = "prog.asm"
+	for err = nil; err == nil; {
+		_, err = lexer.NextToken()
+	}
+	expected := "prog.asm:2:8: invalid token (hexadecimal number without digits)"
+	if err.Error() != expected {
+		t.Errorf("wrong error, expected \"%s\", got \"%s\"", expected, err.Error())
+	}
+}
+
+func TestBinary(t *testing.T) {
+	lexer := newLexer(("01_!"))
+
+	thisChar, err := lexer.source.NextRune()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	testCases := []StateCase{
+		{rune('1'), ST_BINARY, TK_UNKNOWN},
+		{rune('_'), ST_BINARY, TK_UNKNOWN},
+		{rune('!'), ST_BINARY, TK_UNKNOWN},
+		{rune('!'), ST_END, TK_BINARY},
+	}
+
+	state := ST_BINARY
+	token := TK_UNKNOWN
+	for id, c := range testCases {
+		state, thisChar, token, err = lexer.step(ST_BINARY, thisChar)
+		c.verify(t, id, state, thisChar, token, err)
+	}
+
+	_, _, _, err = lexer.step(ST_BINARY, rune('2'))
+	if err == nil {
+		t.Errorf("expected \"invalid token (digit '2' in binary number)\" error")
+	}
+
+	lexer = newLexer("nop\n\tpushi 0b\n")
+	lexer.source.file = "prog.asm"
+	for err = nil; err == nil; {
+		_, err = lexer.NextToken()
+	}
+	expected := "prog.asm:2:8: invalid token (binary number without digits)"
+	if err.Error() != expected {
+		t.Errorf("wrong error, expected \"%s\", got \"%s\"", expected, err.Error())
+	}
+}
+
+func TestOctal(t *testing.T) {
+	lexer := newLexer(("07_!"))
+
+	thisChar, err := lexer.source.NextRune()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	testCases := []StateCase{
+		{rune('7'), ST_OCTAL, TK_UNKNOWN},
+		{rune('_'), ST_OCTAL, TK_UNKNOWN},
+		{rune('!'), ST_OCTAL, TK_UNKNOWN},
+		{rune('!'), ST_END, TK_OCTAL},
+	}
+
+	state := ST_OCTAL
+	token := TK_UNKNOWN
+	for id, c := range testCases {
+		state, thisChar, token, err = lexer.step(ST_OCTAL, thisChar)
+		c.verify(t, id, state, thisChar, token, err)
+	}
+
+	_, _, _, err = lexer.step(ST_OCTAL, rune('8'))
+	if err == nil {
+		t.Errorf("expected \"invalid token (digit '8' in octal number)\" error")
+	}
+
+	lexer = newLexer("nop\n\tpushi 0o\n")
+	lexer.source.file = "prog.asm"
+	for err = nil; err == nil; {
+		_, err = lexer.NextToken()
+	}
+	expected := "prog.asm:2:8: invalid token (octal number without digits)"
+	if err.Error() != expected {
+		t.Errorf("wrong error, expected \"%s\", got \"%s\"", expected, err.Error())
+	}
 }
 
 func TestFractionStart(t *testing.T) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString(("09"))
+	lexer := newLexer(("09"))
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	testCases := []StateCase{
-		{rune('9'), ST_FRACTION, TK_UNKNOWN, "0"},
-		{rune(0x04), ST_FRACTION, TK_UNKNOWN, "9"},
+		{rune('9'), ST_FRACTION, TK_UNKNOWN},
+		{END_OF_FILE, ST_FRACTION, TK_UNKNOWN},
 	}
 
 	state := ST_FRACTION_START
-	token := NewToken()
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = fraction_start(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_FRACTION_START, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
-		token = token.clear()
 	}
 
-	_, _, _, err = fraction_start(rune('.'), token)
+	_, _, _, err = lexer.step(ST_FRACTION_START, rune('.'))
 	if err == nil {
 		t.Errorf("expected \"invalid token (malformed number)\" error")
 	}
 
-	_, _, _, err = fraction_start(rune('!'), token)
+	_, _, _, err = lexer.step(ST_FRACTION_START, rune('!'))
 	if err == nil {
 		t.Errorf("expected \"invalid token (malformed number)\" error")
 	}
 }
 
+func TestDot(t *testing.T) {
+	lexer := newLexer(("b9"))
+
+	thisChar, err := lexer.source.NextRune()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	testCases := []StateCase{
+		{rune('9'), ST_IDENTIFIER, TK_UNKNOWN},
+		{END_OF_FILE, ST_FRACTION, TK_UNKNOWN},
+	}
+
+	for id, c := range testCases {
+		state, nextChar, token, err := lexer.step(ST_DOT, thisChar)
+		c.verify(t, id, state, nextChar, token, err)
+		thisChar = nextChar
+	}
+
+	_, _, _, err = lexer.step(ST_DOT, rune('!'))
+	if err == nil {
+		t.Errorf("expected \"invalid token (expected decimal)\" error")
+	}
+}
+
 func TestFraction(t *testing.T) {
-	sourceCode = NewSourceCode()
-	sourceCode.LoadString(("09"))
+	lexer := newLexer(("09"))
 
-	thisChar, err := sourceCode.NextRune()
+	thisChar, err := lexer.source.NextRune()
 	if err != nil {
 		t.Errorf(err.Error())
 	}
 
 	testCases := []StateCase{
-		{rune('9'), ST_FRACTION, TK_UNKNOWN, "0"},
-		{rune(0x04), ST_FRACTION, TK_UNKNOWN, "9"},
+		{rune('9'), ST_FRACTION, TK_UNKNOWN},
+		{END_OF_FILE, ST_FRACTION, TK_UNKNOWN},
 	}
 
-	state := ST_FRACTION_START
-	token := NewToken()
+	state := ST_FRACTION
+	token := TK_UNKNOWN
 	for id, c := range testCases {
-		state, thisChar, token, err = fraction(thisChar, token)
+		state, thisChar, token, err = lexer.step(ST_FRACTION, thisChar)
 		c.verify(t, id, state, thisChar, token, err)
-		token = token.clear()
 	}
 
-	testCase := StateCase{rune('.'), ST_END, TK_FLOAT, ""}
-	state, thisChar, token, err = fraction(rune('.'), token)
+	testCase := StateCase{rune('.'), ST_END, TK_FLOAT}
+	state, thisChar, token, err = lexer.step(ST_FRACTION, rune('.'))
 	testCase.verify(t, -1, state, thisChar, token, err)
-	token.clear()
 
-	testCase = StateCase{rune('!'), ST_END, TK_FLOAT, ""}
-	state, thisChar, token, err = fraction(rune('!'), token)
+	testCase = StateCase{rune('!'), ST_END, TK_FLOAT}
+	state, thisChar, token, err = lexer.step(ST_FRACTION, rune('!'))
 	testCase.verify(t, -1, state, thisChar, token, err)
-	token.clear()
 
 }
 
+func TestString(t *testing.T) {
+	lexer := newLexer("a\\\"\"!")
+
+	thisChar, err := lexer.source.NextRune()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	testCases := []StateCase{
+		{rune('\\'), ST_STRING, TK_UNKNOWN},
+		{rune('"'), ST_STRING_ESCAPE, TK_UNKNOWN},
+		{rune('"'), ST_STRING, TK_UNKNOWN},
+		{rune('!'), ST_END, TK_STRING},
+	}
+
+	state := ST_STRING
+	token := TK_UNKNOWN
+	for id, c := range testCases {
+		state, thisChar, token, err = lexer.step(state, thisChar)
+		c.verify(t, id, state, thisChar, token, err)
+	}
+
+	_, _, _, err = lexer.step(ST_STRING, rune('\n'))
+	if err == nil {
+		t.Errorf("expected \"invalid token (unterminated string)\" error")
+	}
+	_, _, _, err = lexer.step(ST_STRING_ESCAPE, END_OF_FILE)
+	if err == nil {
+		t.Errorf("expected \"invalid token (unterminated string)\" error")
+	}
+}
+
+func TestChar(t *testing.T) {
+	lexer := newLexer("\\''!")
+
+	thisChar, err := lexer.source.NextRune()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	testCases := []StateCase{
+		{rune('\''), ST_CHAR_ESCAPE, TK_UNKNOWN},
+		{rune('\''), ST_CHAR, TK_UNKNOWN},
+		{rune('!'), ST_END, TK_CHAR},
+	}
+
+	state := ST_CHAR
+	token := TK_UNKNOWN
+	for id, c := range testCases {
+		state, thisChar, token, err = lexer.step(state, thisChar)
+		c.verify(t, id, state, thisChar, token, err)
+	}
+
+	_, _, _, err = lexer.step(ST_CHAR, rune('\n'))
+	if err == nil {
+		t.Errorf("expected \"invalid token (unterminated character)\" error")
+	}
+}
+
+func TestStringErrors(t *testing.T) {
+	testCases := []string{
+		"\"hello",          // unterminated
+		"\"hello\nworld\"", // unterminated
+		"\"\\q\"",          // invalid escape
+		"\"\\x4\"",         // invalid escape
+		"'AB'",             // too long
+		"''",               // too short
+		"'A",               // unterminated
+	}
+
+	for i, c := range testCases {
+		lexer := newLexer(c)
+		_, err := lexer.NextToken()
+		if err == nil {
+			t.Errorf("CaseID %d: expected an error for %s", i, c)
+		}
+	}
+}
+
+func TestShift(t *testing.T) {
+	testCase := StateCase{END_OF_FILE, ST_END, TK_SHIFT_LEFT}
+	lexer := newLexer("")
+	state, thisChar, token, err := lexer.step(ST_SHIFT_LEFT, rune('<'))
+	testCase.verify(t, 0, state, thisChar, token, err)
+
+	testCase = StateCase{END_OF_FILE, ST_END, TK_SHIFT_RIGHT}
+	state, thisChar, token, err = lexer.step(ST_SHIFT_RIGHT, rune('>'))
+	testCase.verify(t, 1, state, thisChar, token, err)
+
+	_, _, _, err = lexer.step(ST_SHIFT_LEFT, rune('!'))
+	if err == nil {
+		t.Errorf("expected \"unknown token (expected '<<')\" error")
+	}
+	_, _, _, err = lexer.step(ST_SHIFT_RIGHT, rune('<'))
+	if err == nil {
+		t.Errorf("expected \"unknown token (expected '>>')\" error")
+	}
+}
+
+func TestAnonymous(t *testing.T) {
+	lexer := newLexer("")
+	testCases := []StateCase{
+		{END_OF_FILE, ST_END, TK_IDENTIFIER},
+		{END_OF_FILE, ST_END, TK_IDENTIFIER},
+		{END_OF_FILE, ST_END, TK_IDENTIFIER},
+	}
+	for i, c := range []rune{'@', 'F', 'b'} {
+		state, thisChar, token, err := lexer.step(ST_ANONYMOUS, c)
+		testCases[i].verify(t, i, state, thisChar, token, err)
+	}
+
+	_, _, _, err := lexer.step(ST_ANONYMOUS, rune('x'))
+	if err == nil {
+		t.Errorf("expected \"unknown token (expected '@@', '@f' or '@b')\" error")
+	}
+}
+
+func TestExponent(t *testing.T) {
+	lexer := newLexer("-12!")
+
+	thisChar, err := lexer.source.NextRune()
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	testCases := []StateCase{
+		{rune('1'), ST_EXPONENT_SIGN, TK_UNKNOWN},
+		{rune('2'), ST_EXPONENT, TK_UNKNOWN},
+		{rune('!'), ST_EXPONENT, TK_UNKNOWN},
+		{rune('!'), ST_END, TK_FLOAT},
+	}
+
+	state := ST_EXPONENT_START
+	token := TK_UNKNOWN
+	for id, c := range testCases {
+		state, thisChar, token, err = lexer.step(state, thisChar)
+		c.verify(t, id, state, thisChar, token, err)
+	}
+
+	_, _, _, err = lexer.step(ST_EXPONENT_START, rune('!'))
+	if err == nil {
+		t.Errorf("expected \"invalid token (malformed exponent)\" error")
+	}
+	_, _, _, err = lexer.step(ST_EXPONENT_SIGN, rune('-'))
+	if err == nil {
+		t.Errorf("expected \"invalid token (malformed exponent)\" error")
+	}
+}
+
 // - Test Tokenizer -------------------------------------------------------------------------------------------------------------
 
 func TestNextToken(t *testing.T) {
@@ -444,15 +733,306 @@ func TestNextToken(t *testing.T) {
 	// TK_BRACE_OPEN
 	// TK_BRACE_CLOSE
 	// TK_END_OF_LINE
+	// TK_COMMA
+	// TK_STRING
+	// TK_CHAR
+	// TK_BINARY
+	// TK_OCTAL
 
 	testCases := []TokenizerCase{
-		{"Identifier", TK_IDENTIFIER, "Identifier", rune(0x04)},
+		{"Identifier", TK_IDENTIFIER, "Identifier", END_OF_FILE},
 		{"Identifier\n", TK_IDENTIFIER, "Identifier", rune('\n')},
-		{"_ID", TK_IDENTIFIER, "_ID", rune(0x04)},
-		{"0", TK_INTEGER, "0", rune(0x04)},
+		{"_ID", TK_IDENTIFIER, "_ID", END_OF_FILE},
+		{"start.loop,", TK_IDENTIFIER, "start.loop", rune(',')},
+		{"0", TK_INTEGER, "0", END_OF_FILE},
+		{".byte 1", TK_DIRECTIVE, ".byte", rune(' ')},
+		{".5", TK_FLOAT, ".5", END_OF_FILE},
+		{", 1", TK_COMMA, "", rune(' ')},
+		{"\"hello\" ", TK_STRING, "hello", rune(' ')},
+		{"\"\"", TK_STRING, "", END_OF_FILE},
+		{"\"a\\n\\t\\x41\\u00e9\\\\\\\"\"", TK_STRING, "a\n\tA\u00e9\\\"", END_OF_FILE},
+		{"'A',", TK_CHAR, "A", rune(',')},
+		{"'\\''", TK_CHAR, "'", END_OF_FILE},
+		{"'\\\"'", TK_CHAR, "\"", END_OF_FILE},
+		{"'\\x41'", TK_CHAR, "A", END_OF_FILE},
+		{"'\u00e9'", TK_CHAR, "\u00e9", END_OF_FILE},
+		{"0b1010_0001 ", TK_BINARY, "10100001", rune(' ')},
+		{"0B1", TK_BINARY, "1", END_OF_FILE},
+		{"0o755,", TK_OCTAL, "755", rune(',')},
+		{"0O7_7", TK_OCTAL, "77", END_OF_FILE},
+		{"0xFF_FF", TK_HEXADECIMAL, "FFFF", END_OF_FILE},
+		{"1_000_000", TK_INTEGER, "1000000", END_OF_FILE},
+		{"0_1", TK_INTEGER, "01", END_OF_FILE},
+		{"-1_0", TK_INTEGER, "-10", END_OF_FILE},
+		{"-0x1F", TK_HEXADECIMAL, "-1F", END_OF_FILE},
+		{"-0B1 ", TK_BINARY, "-1", rune(' ')},
+		{"-0o7,", TK_OCTAL, "-7", rune(',')},
+		{"-07", TK_INTEGER, "-07", END_OF_FILE},
+		{"-0,", TK_INTEGER, "-0", rune(',')},
+		{"1e-9", TK_FLOAT, "1e-9", END_OF_FILE},
+		{"6.02E23 ", TK_FLOAT, "6.02E23", rune(' ')},
+		{"-2.5e+3", TK_FLOAT, "-2.5e+3", END_OF_FILE},
+		{"0e0", TK_FLOAT, "0e0", END_OF_FILE},
+		{"inf", TK_FLOAT, "inf", END_OF_FILE},
+		{"NaN,", TK_FLOAT, "NaN", rune(',')},
+		{"info", TK_IDENTIFIER, "info", END_OF_FILE},
+		{"jmp", TK_MNEMONIC, "jmp", END_OF_FILE},
+		{"JMP ", TK_MNEMONIC, "JMP", rune(' ')},
+		{".Equ", TK_DIRECTIVE, ".Equ", END_OF_FILE},
+		{"jmps", TK_IDENTIFIER, "jmps", END_OF_FILE},
+		{"+1", TK_PLUS, "", rune('1')},
+		{"- 1", TK_MINUS, "", rune(' ')},
+		{"-x", TK_MINUS, "", rune('x')},
+		{"*", TK_STAR, "", END_OF_FILE},
+		{"/2", TK_SLASH, "", rune('2')},
+		{"%", TK_PERCENT, "", END_OF_FILE},
+		{"<<1", TK_SHIFT_LEFT, "", rune('1')},
+		{">>1", TK_SHIFT_RIGHT, "", rune('1')},
+		{"&", TK_AMPERSAND, "", END_OF_FILE},
+		{"|", TK_PIPE, "", END_OF_FILE},
+		{"^", TK_CARET, "", END_OF_FILE},
+		{"~x", TK_TILDE, "", rune('x')},
 	}
 
 	for i, c := range testCases {
 		c.verify(t, i)
 	}
 }
+
+func TestTokenPosition(t *testing.T) {
+	lexer := newLexer("start: jmp\n  end")
+
+	expected := []struct {
+		token      int
+		start, end Position
+	}{
+		{TK_IDENTIFIER, Position{"", 1, 1, 0}, Position{"", 1, 6, 5}},
+		{TK_COLON, Position{"", 1, 6, 5}, Position{"", 1, 7, 6}},
+		{TK_MNEMONIC, Position{"", 1, 8, 7}, Position{"", 1, 11, 10}},
+		{TK_END_OF_LINE, Position{"", 1, 11, 10}, Position{"", 2, 1, 11}},
+		{TK_IDENTIFIER, Position{"", 2, 3, 13}, Position{"", 2, 6, 16}},
+	}
+
+	for i, e := range expected {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatalf("CaseID %d: %s", i, err.Error())
+		}
+		if token.token != e.token {
+			t.Errorf("CaseID %d: wrong token, expected %d, got %d", i, e.token, token.token)
+		}
+		if token.start != e.start {
+			t.Errorf("CaseID %d: wrong start, expected %v, got %v", i, e.start, token.start)
+		}
+		if token.end != e.end {
+			t.Errorf("CaseID %d: wrong end, expected %v, got %v", i, e.end, token.end)
+		}
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	lexer := newLexer("nop\r\nhalt // done\r\rret\n")
+
+	expected := []struct {
+		token int
+		start Position
+	}{
+		{TK_MNEMONIC, Position{"", 1, 1, 0}},
+		{TK_END_OF_LINE, Position{"", 1, 4, 3}},
+		{TK_MNEMONIC, Position{"", 2, 1, 5}},
+		{TK_END_OF_LINE, Position{"", 2, 6, 10}},
+		{TK_END_OF_LINE, Position{"", 3, 1, 18}},
+		{TK_MNEMONIC, Position{"", 4, 1, 19}},
+		{TK_END_OF_LINE, Position{"", 4, 4, 22}},
+	}
+
+	for i, e := range expected {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatalf("CaseID %d: %s", i, err.Error())
+		}
+		if token.token != e.token {
+			t.Errorf("CaseID %d: wrong token, expected %d, got %d", i, e.token, token.token)
+		}
+		if token.start != e.start {
+			t.Errorf("CaseID %d: wrong start, expected %v, got %v", i, e.start, token.start)
+		}
+	}
+	if !lexer.atEnd() {
+		t.Errorf("expected the end of the source code")
+	}
+}
+
+func TestEndOfFile(t *testing.T) {
+	lexer := newLexer("nop // done")
+
+	expected := []struct {
+		token int
+		start Position
+	}{
+		{TK_MNEMONIC, Position{"", 1, 1, 0}},
+		{TK_END_OF_FILE, Position{"", 1, 12, 11}},
+		{TK_END_OF_FILE, Position{"", 1, 12, 11}},
+	}
+
+	for i, e := range expected {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatalf("CaseID %d: %s", i, err.Error())
+		}
+		if token.token != e.token {
+			t.Errorf("CaseID %d: wrong token, expected %d, got %d", i, e.token, token.token)
+		}
+		if token.start != e.start {
+			t.Errorf("CaseID %d: wrong start, expected %v, got %v", i, e.start, token.start)
+		}
+	}
+
+	// the EOT character is just a character, not the end of the file
+	lexer = newLexer("\x04")
+	if _, err := lexer.NextToken(); err == nil || err.Error() != "1:1: unknown token" {
+		t.Errorf("expected the error \"1:1: unknown token\", got %v", err)
+	}
+	lexer = newLexer("\"\x04\"")
+	if token, err := lexer.NextToken(); err != nil || token.token != TK_STRING || token.Value() != "\x04" {
+		t.Errorf("expected a string with the EOT character, got %v (%v)", token, err)
+	}
+}
+
+func TestTokenError(t *testing.T) {
+	lexer := newLexer("nop\n\tpushi 0b12")
+	lexer.source.file = "prog.asm"
+
+	var err error
+	for err == nil {
+		_, err = lexer.NextToken()
+	}
+	expected := "prog.asm:2:8: invalid token (digit '2' in binary number)"
+	if err.Error() != expected {
+		t.Errorf("wrong error, expected \"%s\", got \"%s\"", expected, err.Error())
+	}
+}
+
+func TestTokenSpans(t *testing.T) {
+	// enough tokens to fill several chunks, each token has to keep its own text
+	var source strings.Builder
+	for i := 0; source.Len() < 3*SOURCE_BUFFER_SIZE; i++ {
+		fmt.Fprintf(&source, "label%d: .byte 0x%X, \"é\\x41\" // comment\n", i, i)
+	}
+	lexer := newLexer(source.String())
+
+	tokens := []Token{}
+	for {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatalf("error: %s", err.Error())
+		}
+		if token.token == TK_END_OF_FILE {
+			break
+		}
+		tokens = append(tokens, token)
+	}
+	for i := 0; i*7 < len(tokens); i++ {
+		line := tokens[i*7 : i*7+7]
+		expected := []string{fmt.Sprintf("label%d", i), ":", ".byte", fmt.Sprintf("0x%X", i), ",", "\"é\\x41\"", "// comment\n"}
+		for j, token := range line {
+			if token.Text() != expected[j] {
+				t.Fatalf("CaseID %d: wrong text, expected %q, got %q", i*7+j, expected[j], token.Text())
+			}
+		}
+		if line[5].Value() != "éA" {
+			t.Fatalf("CaseID %d: wrong value, expected \"éA\", got %q", i*7+5, line[5].Value())
+		}
+	}
+}
+
+func TestLongTokenSpan(t *testing.T) {
+	// a token longer than a chunk gets a chunk of its own, the tokens around it keep their text
+	text := "\"" + strings.Repeat("é", SOURCE_BUFFER_SIZE) + "\""
+	lexer := newLexer("start: .byte " + text + ", end\n")
+
+	expected := []string{"start", ":", ".byte", text, ",", "end"}
+	tokens := []Token{}
+	for range expected {
+		token, err := lexer.NextToken()
+		if err != nil {
+			t.Fatalf("error: %s", err.Error())
+		}
+		tokens = append(tokens, token)
+	}
+	for i, token := range tokens {
+		if token.Text() != expected[i] {
+			t.Errorf("CaseID %d: wrong text, expected %d bytes, got %d", i, len(expected[i]), len(token.Text()))
+		}
+	}
+	if position := tokens[4].start; position.column != 14+SOURCE_BUFFER_SIZE+2 {
+		t.Errorf("wrong position of ',', expected column %d, got %v", 14+SOURCE_BUFFER_SIZE+2, position)
+	}
+}
+
+// - Benchmarks -----------------------------------------------------------------------------------------------------------------
+
+// benchmarkSource generates a source code of at least the given size, with a bit of everything the tokenizer reads
+func benchmarkSource(size int) string {
+	var source strings.Builder
+	for i := 0; source.Len() < size; i++ {
+		fmt.Fprintf(&source, "loop%d:  pushi 0x1f_ff + %d * 2 // count down\n", i%100, i)
+		fmt.Fprintf(&source, "        jnz loop%d\n", i%100)
+		fmt.Fprintf(&source, "table:  .byte 1, 0b1010, 0o17, 'A', \"text\"\n")
+		fmt.Fprintf(&source, "        .float 2.5e-3, -1.0\n")
+	}
+	return source.String()
+}
+
+// lexAll reads all tokens of the source code
+func lexAll(lexer *Lexer) (count int, err error) {
+	for {
+		var token Token
+		token, err = lexer.NextToken()
+		if err != nil || token.token == TK_END_OF_FILE {
+			return
+		}
+		count++
+	}
+}
+
+func TestTokenAllocations(t *testing.T) {
+	line := "start: jmp start // tokens refer to the source code\n"
+	allocations := func(lines int) float64 {
+		source := strings.Repeat(line, lines)
+		return testing.AllocsPerRun(10, func() {
+			if _, err := lexAll(newLexer(source)); err != nil {
+				t.Fatalf("error: %s", err.Error())
+			}
+		})
+	}
+	// the lexer and its buffers are allocated once, reading the same line again should not add anything
+	few, many := allocations(1), allocations(1000)
+	if many > few {
+		t.Errorf("expected %.0f allocations for 1000 lines, like for a single line, got %.0f", few, many)
+	}
+}
+
+func BenchmarkNextToken(b *testing.B) {
+	source := benchmarkSource(4 << 20)
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := lexAll(newLexer(source)); err != nil {
+			b.Fatalf("error: %s", err.Error())
+		}
+	}
+}
+
+func BenchmarkLongToken(b *testing.B) {
+	source := strings.Repeat(".byte \""+strings.Repeat("x", 64<<10)+"\"\n", 16)
+	b.SetBytes(int64(len(source)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := lexAll(newLexer(source)); err != nil {
+			b.Fatalf("error: %s", err.Error())
+		}
+	}
+}